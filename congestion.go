@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AIMD congestion window limiting the number of GetDatum in flight to a peer
+type congestionWindow struct {
+	Cwnd         float64 // Number of requests allowed in flight
+	Ssthresh     float64 // Slow start while Cwnd < Ssthresh, then additive increase
+	InFlight     int
+	NbLosses     int
+	LastDecrease time.Time
+	cond         *sync.Cond // Signaled when InFlight or Cwnd change
+}
+
+// Protected by a Mutex that also protects the fields of the windows
+// Maps a peer name to its window
+var congestionWindows map[string]*congestionWindow
+var congestionWindowsMutex *sync.Mutex
+
+// Assumes that congestionWindowsMutex is locked
+func congestionWindowGet(peerName string) *congestionWindow {
+	w, found := congestionWindows[peerName]
+	if !found {
+		w = &congestionWindow{Cwnd: INITIAL_CWND, Ssthresh: MAX_CWND, cond: sync.NewCond(congestionWindowsMutex)}
+		congestionWindows[peerName] = w
+	}
+	return w
+}
+
+// Waits until the window of peerName allows one more request in flight and takes the slot
+func congestionWindowAcquire(peerName string) {
+	congestionWindowsMutex.Lock()
+	defer congestionWindowsMutex.Unlock()
+
+	w := congestionWindowGet(peerName)
+	for w.InFlight >= int(w.Cwnd) {
+		w.cond.Wait()
+	}
+	w.InFlight++
+}
+
+// Like congestionWindowAcquire but returns false instead of waiting
+func congestionWindowTryAcquire(peerName string) bool {
+	congestionWindowsMutex.Lock()
+	defer congestionWindowsMutex.Unlock()
+
+	w := congestionWindowGet(peerName)
+	if w.InFlight >= int(w.Cwnd) {
+		return false
+	}
+	w.InFlight++
+	return true
+}
+
+// Frees a slot taken by congestionWindow[Try]Acquire
+func congestionWindowRelease(peerName string) {
+	congestionWindowsMutex.Lock()
+	defer congestionWindowsMutex.Unlock()
+
+	w := congestionWindowGet(peerName)
+	w.InFlight--
+	w.cond.Broadcast()
+}
+
+// Called by sendToAddrAndReceiveMsgWithReemissions when a request to peerName is answered without reemission
+func congestionWindowOnReply(peerName string) {
+	if peerName == "" {
+		return
+	}
+
+	congestionWindowsMutex.Lock()
+	defer congestionWindowsMutex.Unlock()
+
+	w := congestionWindowGet(peerName)
+	if w.Cwnd < w.Ssthresh {
+		w.Cwnd++
+	} else {
+		w.Cwnd += 1 / w.Cwnd
+	}
+	w.Cwnd = min(w.Cwnd, MAX_CWND)
+	w.cond.Broadcast()
+}
+
+// Called by sendToAddrAndReceiveMsgWithReemissions when a request to addr of peerName must be reemitted
+// The window is halved at most once per RTO because all the requests in flight when the link congested time out together
+func congestionWindowOnLoss(peerName string, addr *net.UDPAddr) {
+	if peerName == "" {
+		return
+	}
+
+	rto := rttGetRto(addr)
+
+	congestionWindowsMutex.Lock()
+	defer congestionWindowsMutex.Unlock()
+
+	w := congestionWindowGet(peerName)
+	w.NbLosses++
+	if time.Since(w.LastDecrease) < rto {
+		return
+	}
+	w.Ssthresh = max(w.Cwnd/2, MIN_CWND)
+	w.Cwnd = w.Ssthresh
+	w.LastDecrease = time.Now()
+}
+
+func printCongestionWindows() {
+	congestionWindowsMutex.Lock()
+	defer congestionWindowsMutex.Unlock()
+
+	peerNames := make([]string, 0, len(congestionWindows))
+	for p := range congestionWindows {
+		peerNames = append(peerNames, p)
+	}
+	sort.Strings(peerNames)
+
+	for _, p := range peerNames {
+		w := congestionWindows[p]
+		fmt.Printf("Congestion window of %s: %.1f (ssthresh %.1f), %d in flight, %d losses\n", p, w.Cwnd, w.Ssthresh, w.InFlight, w.NbLosses)
+	}
+}
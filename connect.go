@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"time"
+)
+
+// Returns nil if there is no preferred address or if it was removed from peers e.g. by keepAlivePeers
+func (n *udpNode) peerPreferredAddrGet(peerName string) *net.UDPAddr {
+	n.preferredAddrsMutex.Lock()
+	a := n.preferredAddrs[peerName]
+	n.preferredAddrsMutex.Unlock()
+
+	if a == nil {
+		return nil
+	}
+
+	addresses, _ := n.peersGet(peerName)
+	if !addrIsInSlice(addresses, a) {
+		n.peerPreferredAddrForget(peerName, a)
+		return nil
+	}
+	return a
+}
+
+func (n *udpNode) peerPreferredAddrSet(peerName string, addr *net.UDPAddr) {
+	n.preferredAddrsMutex.Lock()
+	n.preferredAddrs[peerName] = addr
+	n.preferredAddrsMutex.Unlock()
+}
+
+// Forgets addr only if it is still the preferred address, another race may have replaced it
+func (n *udpNode) peerPreferredAddrForget(peerName string, addr *net.UDPAddr) {
+	n.preferredAddrsMutex.Lock()
+	defer n.preferredAddrsMutex.Unlock()
+
+	a, found := n.preferredAddrs[peerName]
+	if found && a.String() == addr.String() {
+		delete(n.preferredAddrs, peerName)
+	}
+}
+
+// Addresses of the networks of our interfaces e.g. 192.168.1.0/24
+func localNetworks() []*net.IPNet {
+	res := []*net.IPNet{}
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return res
+	}
+	for _, a := range addresses {
+		ipNet, ok := a.(*net.IPNet)
+		if ok {
+			res = append(res, ipNet)
+		}
+	}
+	return res
+}
+
+// Preference of addr when connecting to a peer, the lower the better
+//   - behindOurNat: the peer has the same public IP as us, so its LAN addresses are reachable and faster
+//
+// Otherwise its private addresses are most likely on another LAN and only tried last
+func addrRank(addr *net.UDPAddr, behindOurNat bool, networks []*net.IPNet) int {
+	sameSubnet := slices.ContainsFunc(networks, func(n *net.IPNet) bool { return n.Contains(addr.IP) })
+	private := addr.IP.IsPrivate() || addr.IP.IsLoopback() || addr.IP.IsLinkLocalUnicast()
+
+	switch {
+	case behindOurNat && sameSubnet:
+		return 0
+	case behindOurNat && private:
+		return 1
+	case !private:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// Sorts candidates by addrRank, keeping the order of the REST server among equal ranks
+func sortCandidates(candidates []*net.UDPAddr) {
+	ourIPs := []net.IP{}
+	for _, a := range ourObservedAddrsGet() {
+		ourIPs = append(ourIPs, a.IP)
+	}
+
+	behindOurNat := slices.ContainsFunc(candidates, func(a *net.UDPAddr) bool {
+		return slices.ContainsFunc(ourIPs, a.IP.Equal)
+	})
+
+	networks := localNetworks()
+	slices.SortStableFunc(candidates, func(a, b *net.UDPAddr) int {
+		return addrRank(a, behindOurNat, networks) - addrRank(b, behindOurNat, networks)
+	})
+}
+
+type raceResult struct {
+	Addr *net.UDPAddr
+	Err  error
+}
+
+// Happy eyeballs (RFC 8305): runs probe on candidates in order, starting the next one CONNECT_STAGGER after the previous or as soon as it failed
+// Returns the first candidate whose probe succeeded, the other probes are then cancelled
+func raceAddresses(candidates []*net.UDPAddr, probe func(addr *net.UDPAddr, cancel <-chan struct{}) error) (*net.UDPAddr, error) {
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no address to try")
+	}
+
+	results := make(chan raceResult, len(candidates)) // Buffered so that cancelled probes don't block
+	cancel := make(chan struct{})
+	defer close(cancel)
+
+	nbStarted, nbRunning := 0, 0
+	startNext := func() {
+		a := candidates[nbStarted]
+		nbStarted++
+		nbRunning++
+		go func() {
+			results <- raceResult{a, probe(a, cancel)}
+		}()
+	}
+
+	startNext()
+	timer := time.NewTimer(CONNECT_STAGGER)
+	defer timer.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case r := <-results:
+			nbRunning--
+			if r.Err == nil {
+				return r.Addr, nil
+			}
+			LOGGING_FUNC("Probe of", r.Addr.String(), "failed:", r.Err)
+			lastErr = r.Err
+			if nbStarted < len(candidates) {
+				startNext()
+				timer.Reset(CONNECT_STAGGER)
+			} else if nbRunning == 0 {
+				return nil, lastErr
+			}
+		case <-timer.C:
+			if nbStarted < len(candidates) {
+				startNext()
+				timer.Reset(CONNECT_STAGGER)
+			}
+		}
+	}
+}
+
+// A connection to a peer in progress, the other connections to the same peer wait for it
+type peerConnection struct {
+	done chan struct{} // Closed when the connection is over, addr and err are then set
+	addr *net.UDPAddr
+	err  error
+}
+
+// Connects to peerName with raceToPeer, or waits for the connection in progress to peerName
+// Concurrent downloads from a peer that lost its preferred address would otherwise each race all its addresses
+func (n *udpNode) connectToPeer(peerName string) (*net.UDPAddr, error) {
+	n.connectionsMutex.Lock()
+	c, found := n.connections[peerName]
+	if !found {
+		c = &peerConnection{done: make(chan struct{})}
+		n.connections[peerName] = c
+	}
+	n.connectionsMutex.Unlock()
+
+	if found {
+		LOGGING_FUNC("Connection to", peerName, "already in progress, waiting for it")
+		<-c.done
+		return c.addr, c.err
+	}
+
+	c.addr, c.err = n.raceToPeer(peerName)
+
+	n.connectionsMutex.Lock()
+	delete(n.connections, peerName)
+	n.connectionsMutex.Unlock()
+
+	close(c.done)
+	return c.addr, c.err
+}
+
+// Finds the fastest address of peerName: races Hellos to its known and REST addresses, then NAT traversals to its REST addresses
+// The address found is added to peers and becomes the preferred address of the peer
+func (n *udpNode) raceToPeer(peerName string) (*net.UDPAddr, error) {
+	candidates := []*net.UDPAddr{}
+	addCandidate := func(a *net.UDPAddr) {
+		if n.udpAddrIsReachable(a) && !addrIsInSlice(candidates, a) {
+			candidates = append(candidates, a)
+		}
+	}
+
+	addressesInPeers, _ := n.peersGet(peerName)
+	for _, a := range addressesInPeers {
+		addCandidate(a)
+	}
+
+	restPeerAddresses, restErr := restGetAddressesOfPeer(peerName, false)
+	for _, a := range restPeerAddresses {
+		addCandidate(a)
+	}
+
+	if len(candidates) == 0 {
+		if restErr != nil {
+			return nil, restErr
+		}
+		return nil, fmt.Errorf("can't resolve or communicate with peer %s", peerName)
+	}
+
+	sortCandidates(candidates)
+
+	helloProbe := func(a *net.UDPAddr, cancel <-chan struct{}) error {
+		_, err := n.sendToAddrAndReceiveMsgWithReemissionsOrCancel(a, createHello(n.Name), cancel)
+		return err
+	}
+
+	winner, err := raceAddresses(candidates, helloProbe)
+	if err != nil {
+		// Only the public addresses given by the REST server can be behind a NAT that the main peer can reach
+		natCandidates := []*net.UDPAddr{}
+		for _, a := range restPeerAddresses {
+			if n.udpAddrIsReachable(a) && !a.IP.IsPrivate() && !a.IP.IsLoopback() {
+				natCandidates = append(natCandidates, a)
+			}
+		}
+
+		// natTraversal can't be cancelled, the losers finish in the background
+		winner, err = raceAddresses(natCandidates, func(a *net.UDPAddr, cancel <-chan struct{}) error {
+			return n.natTraversal(a)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("can't resolve or communicate with peer %s: %w", peerName, err)
+		}
+		LOGGING_FUNC("NAT traversal started by us succeeded for", winner.String())
+	}
+
+	LOGGING_FUNC("Connected to", peerName, "through", winner.String())
+	n.peersAddAddr(peerName, winner)
+	n.peerPreferredAddrSet(peerName, winner)
+	return winner, nil
+}
@@ -11,20 +11,57 @@ import (
 
 // TODO Organize this and rename some
 
-const SERVER_ADDRESS = "https://jch.irif.fr:8443"
+// Set by --server
+var SERVER_ADDRESS = "https://jch.irif.fr:8443"
+
 const PEERS_PATH = "/peers/"
 const SERVER_PEER_NAME = "jch.irif.fr"
 const DOWNLOAD_DIR = "PSI-download"
 const SHARED_FILES_DIR = "../PSI-shared-files"
-const UDP_LISTEN_PORT = 8450
+
+// The manifest is written outside SHARED_FILES_DIR and exported at the root of our tree as MANIFEST_NAME
+// Names starting with RESERVED_NAME_PREFIX are ours in an exported tree
+const (
+	RESERVED_NAME_PREFIX = ".psi-"
+	MANIFEST_NAME        = RESERVED_NAME_PREFIX + "manifest"
+	MANIFEST_PATH        = "../" + MANIFEST_NAME
+	BUCKET_PREFIX        = RESERVED_NAME_PREFIX + "bucket-"
+
+	// A name longer than FILENAME_MAX_SIZE keeps its extension if it is no longer than SHORT_NAME_MAX_EXT_SIZE
+	SHORT_NAME_HASH_DIGITS  = 8
+	SHORT_NAME_MAX_EXT_SIZE = 8
+)
+
+var UDP_LISTEN_PORT = 8450 // Set by --port
+const REST_SERVER_DEFAULT_LISTEN_ADDR = ":8080"
+
+// Our REST server asks at most REST_SERVER_MAX_KEY_FETCHES new peers for their key at a time
+// A value PUT to it must be signed with the key of the peer, in hex in the REST_SIGNATURE_HEADER header
+const (
+	REST_SERVER_MAX_KEY_FETCHES = 16
+	REST_SIGNATURE_HEADER       = "X-Psi-Signature"
+)
+
 const KEEP_ALIVE_PERIOD = 30 * time.Second
 
+// Liveness of the addresses of peers other than the main peer
+const (
+	DEFAULT_PEER_ADDRESS_TTL   = 180 * time.Second
+	KEEP_ALIVE_ACTIVITY_WINDOW = 5 * time.Minute // Addresses with activity during this window are kept alive
+	LIVENESS_CHECK_PERIOD      = 10 * time.Second
+)
+
 var OUR_PEER_NAME string
 var OUR_OTHER_PEER_NAME string
 
 var DEBUG bool = false
 
+// Keeps the name given with --name
 func initOurPeerName() {
+	if OUR_PEER_NAME != "" {
+		return
+	}
+
 	hostname, _ := os.Hostname()
 	if hostname == "aetu2" {
 		OUR_PEER_NAME = "AS"
@@ -43,17 +80,116 @@ const PORT_SIZE = 2
 
 var MANDATORILY_SIGNED_MSGS = []byte{HELLO, HELLO_REPLY, ROOT, ROOT_REPLY, PUBLIC_KEY, PUBLIC_KEY_REPLY}
 
-// To achieve 500 ms of waiting for a reply before reemitting the request
-const MSG_QUEUE_MAX_WAIT = 3000 * time.Millisecond
+// Retransmission timeout (time we wait for a reply before reemitting a request) computation as in RFC 6298
+// The RTO doubles at each reemission of a request, so with MAX_RTO a dead address costs at most 1+2+4+4+4 = 15 s
+const (
+	INITIAL_RTO           = 1000 * time.Millisecond // RTO for addresses without RTT sample
+	MIN_RTO               = 100 * time.Millisecond
+	MAX_RTO               = 4000 * time.Millisecond
+	RTT_ALPHA_INVERSE     = 8 // alpha = 1/8
+	RTT_BETA_INVERSE      = 4 // beta = 1/4
+	RTT_K                 = 4
+	RTT_CLOCK_GRANULARITY = time.Millisecond
+)
 
 const NUMBER_OF_REEMISSIONS = 4
 
-const NAT_TRAVERSAL_RETRIES = 10 // We will send Hello (NUMBER_OF_REEMISSIONS + 1) * NAT_TRAVERSAL_RETRIES during our or their NAT traversal
+// Congestion window of the downloads, in number of GetDatum in flight to a peer
+const (
+	INITIAL_CWND = 4.0
+	MIN_CWND     = 1.0
+	MAX_CWND     = 256.0
+)
+
+// Number of chunks or trees of a big file that can be downloaded ahead of the first one not written yet
+const DOWNLOAD_MAX_LOOKAHEAD = 2 * int(MAX_CWND)
+
+// Number of times we request a datum that gets no reply before we give up the download
+const DOWNLOAD_MAX_TRIES = 3
+
+// A signed request whose ID was received from the same peer during the last REPLAY_WINDOW_DURATION is a replay
+// At most REPLAY_WINDOW_SIZE IDs are kept per peer to bound memory, a replay of an older request is then handled again
+const (
+	REPLAY_WINDOW_DURATION = 2 * time.Minute
+	REPLAY_WINDOW_SIZE     = 4096
+)
+
+// After a peer replied in cleartext to a Sealed, we send it cleartext during this time before trying again
+const SEALED_SESSION_DISABLE_DURATION = 5 * time.Minute
+
+// Publication of our key and root to the REST server
+const (
+	REST_PUBLISH_TRIES        = 6
+	REST_PUBLISH_INITIAL_WAIT = 2 * time.Second // The main peer must have received our Hello, which keepAliveMainPeer sends at startup
+)
+
+// Watch of SHARED_FILES_DIR, polled when inotify is not available
+// We re-export once no change happened for SHARED_FILES_SETTLE_DELAY, a copy changes a file many times
+// A file that keeps changing, e.g. a download or a log, is re-exported every SHARED_FILES_MAX_SETTLE_WAIT
+const (
+	SHARED_FILES_POLL_PERIOD     = 2 * time.Second
+	SHARED_FILES_SETTLE_DELAY    = 500 * time.Millisecond
+	SHARED_FILES_MAX_SETTLE_WAIT = 10 * SHARED_FILES_SETTLE_DELAY
+)
+
+// Files are hashed by one worker per CPU, each reading its file through a buffer of HASH_READ_BUFFER_SIZE
+// The progress of a hashing is shown every HASH_PROGRESS_PERIOD, Root and GetDatum get OUR_TREE_NOT_READY until the first one ends
+const (
+	HASH_READ_BUFFER_SIZE = 256 * 1024
+	HASH_PROGRESS_PERIOD  = 2 * time.Second
+	OUR_TREE_NOT_READY    = "our shared files are still being hashed, try again later"
+)
 
-const MSG_QUEUE_SIZE = 8192
+// Delay between the starts of two probes when racing the addresses of a peer, from RFC 8305
+const CONNECT_STAGGER = 250 * time.Millisecond
+
+// A NAT traversal sends a Hello NAT_TRAVERSAL_RETRIES times, waiting from NAT_TRAVERSAL_INITIAL_WAIT to NAT_TRAVERSAL_MAX_WAIT between them
+// Only NAT_TRAVERSAL_SYMMETRIC_RETRIES times over IPv4 if we are behind a symmetric NAT
+const (
+	NAT_TRAVERSAL_RETRIES           = 10
+	NAT_TRAVERSAL_SYMMETRIC_RETRIES = 2
+	NAT_TRAVERSAL_INITIAL_WAIT      = 500 * time.Millisecond
+	NAT_TRAVERSAL_MAX_WAIT          = 8 * time.Second
+)
 
 const PRINT_MSG_BODY_TRUNCATE_SIZE = 100
 
+// Errors and ErrorReplies received are kept for MAX_RECORDED_ERROR_SOURCES peers or addresses, an address that is not a peer for PEER_ERRORS_ADDR_TTL
+// Spoofed sources could flood the prompt, at most PEER_ERRORS_PRINT_RATE of them per second are printed
+const (
+	MAX_RECORDED_ERRORS_PER_PEER = 16
+	MAX_RECORDED_ERROR_SOURCES   = 256
+	PEER_ERRORS_ADDR_TTL         = 10 * time.Minute
+	PEER_ERRORS_PRINT_RATE       = 1.0
+	PEER_ERRORS_PRINT_BURST      = 5.0
+)
+
+// Receive path: requests wait in a queue of REQUEST_QUEUE_SIZE and are handled by NB_REQUEST_WORKERS goroutines
+// On Linux, MAX_SOCKETS_PER_FAMILY descriptors of the socket bound to UDP_LISTEN_PORT each read RECEIVE_BATCH_SIZE datagrams per syscall
+const (
+	NB_REQUEST_WORKERS     = 64
+	REQUEST_QUEUE_SIZE     = 1024
+	MAX_SOCKETS_PER_FAMILY = 4
+	RECEIVE_BATCH_SIZE     = 32
+)
+
+// Number of datagrams a memTransport keeps before dropping, like a socket receive buffer
+const MEM_TRANSPORT_INBOX_SIZE = 4096
+
+// Limits of the requests we handle, rates are in requests per second
+// A downloader keeps up to MAX_CWND GetDatum in flight, bursts must allow that
+// The ErrorReplies to limited, malformed or unsupported requests are limited per address as the address can be spoofed
+const (
+	RATE_LIMIT_ADDR_RATE         = 1000.0
+	RATE_LIMIT_ADDR_BURST        = 2 * MAX_CWND
+	RATE_LIMIT_PEER_RATE         = 2000.0
+	RATE_LIMIT_PEER_BURST        = 4 * MAX_CWND
+	RATE_LIMIT_ERROR_REPLY_RATE  = 1.0
+	RATE_LIMIT_ERROR_REPLY_BURST = 4.0
+
+	REQUEST_SOURCE_IDLE_TIMEOUT = 60 * time.Second
+)
+
 func LOGGING_FUNC(v ...any) {
 	if DEBUG {
 		log.Println(v...)
@@ -85,6 +221,16 @@ const (
 	HTTP_OK         = 200
 )
 
+// A request to the REST server that takes longer fails
+const HTTP_TIMEOUT = 5 * time.Second
+
+// After a failed key lookup the REST server is not asked again for the key of the peer during a wait
+// that doubles from PEER_KEY_RETRY_INITIAL_WAIT to PEER_KEY_RETRY_MAX_WAIT at each failure
+const (
+	PEER_KEY_RETRY_INITIAL_WAIT = 2 * time.Second
+	PEER_KEY_RETRY_MAX_WAIT     = 2 * time.Minute
+)
+
 const ( // UDP message types
 	NOOP                  byte = 0
 	ERROR                 byte = 1
@@ -100,6 +246,8 @@ const ( // UDP message types
 	NO_DATUM              byte = 133
 	NAT_TRAVERSAL_REQUEST byte = 6
 	NAT_TRAVERSAL         byte = 7
+	SEALED                byte = 8
+	SEALED_REPLY          byte = 135
 
 	FIRST_RESPONSE_MSG_TYPE byte = 128
 	MSG_VALID_PAIR          byte = 127
@@ -119,7 +267,6 @@ const ( // Message and datum constants
 	LENGTH_SIZE = 2
 
 	HELLO_EXTENSIONS_SIZE = 4
-	OUR_EXTENSIONS        = 0
 
 	DATUM_TYPE_SIZE = 1
 	CHUNK_MAX_SIZE  = 1024
@@ -142,7 +289,10 @@ const ( // Message and datum constants
 	SIGNATURE_SIZE = 64
 )
 
-const UDP_BUFFER_SIZE int = int(ID_SIZE) + int(TYPE_SIZE) + int(LENGTH_SIZE) +
+// Nonce, inner type and tag of a Sealed[Reply] (AES-GCM)
+const SEALED_OVERHEAD = 12 + TYPE_SIZE + 16
+
+const UDP_BUFFER_SIZE int = int(ID_SIZE) + int(TYPE_SIZE) + int(LENGTH_SIZE) + SEALED_OVERHEAD +
 	int(BODY_MAX_SIZE) + SIGNATURE_SIZE
 
 const KEY_SIZE = 64
@@ -164,16 +314,32 @@ type command struct {
 var CMD_MAP = map[string]command{
 	"EXIT":          {"exit", ": exits the program", 1, readline.PcItem("exit")},
 	"HELP":          {"help", ": shows help message", 1, readline.PcItem("help")},
-	"LIST_PEERS":    {"lspeers", ": shows the connected peers if --addr specified shows also addresses", 1, readline.PcItem("lspeers", readline.PcItem("--addr"))},
+	"LIST_PEERS":    {"lspeers", ": shows the connected peers and the extensions they support, if --addr specified shows also addresses", 1, readline.PcItem("lspeers", readline.PcItem("--addr"))},
 	"LIST_FILES":    {"findrem", " PEER: shows the files shared by PEER", 2, readline.PcItem("findrem", readline.PcItemDynamic(peersListAutoComplete))},
 	"CAT_FILE":      {"curl", " PATH: downloads and shows the file at PATH", 2, readline.PcItem("curl", readline.PcItemDynamic(pathAutoComplete))},
 	"DOWNLOAD_FILE": {"wget", " PATH: downloads recursively the directory or file at PATH", 2, readline.PcItem("wget", readline.PcItemDynamic(pathAutoComplete))},
 	"HELLO":         {"hello", " PEER: sends at least two Hellos to PEER", 2, readline.PcItem("hello", readline.PcItemDynamic(peersListAutoComplete))},
+	"STATS":         {"stats", ": shows counters of the UDP layer", 1, readline.PcItem("stats")},
+	"LIVENESS":      {"liveness", ": shows when we last heard from the addresses of each peer and which ones are kept alive", 1, readline.PcItem("liveness")},
+	"NAT":           {"nat", ": shows our NAT type and the NAT traversals in progress", 1, readline.PcItem("nat")},
+	"RTT":           {"rtt", ": shows the round-trip time estimates of the addresses we sent requests to", 1, readline.PcItem("rtt")},
+	"KEYS":          {"keys", ": shows the pinned keys of peers and the keys that changed", 1, readline.PcItem("keys")},
+	"TRUST":         {"trust", " PEER: pins the new key of PEER after it changed", 2, readline.PcItem("trust", readline.PcItemDynamic(peersListAutoComplete))},
+	"FORGET":        {"forget", " PEER: removes the pinned key of PEER, its next key is trusted on first use", 2, readline.PcItem("forget", readline.PcItemDynamic(peersListAutoComplete))},
+	"SESSIONS":      {"sessions", ": shows which peers we exchange encrypted messages with", 1, readline.PcItem("sessions")},
+	"SERVE_REST":    {"serve-rest", " [LISTEN_ADDR]: runs as the main peer, registering peers from their Hellos and relaying their NAT traversals, and serves its REST API over HTTP on LISTEN_ADDR (default " + REST_SERVER_DEFAULT_LISTEN_ADDR + "), only from the command line", 1, readline.PcItem("serve-rest")},
+	"TRACE":         {"trace", " show FILE [dir=|peer=|addr=|type=...] | diff FILE1 FILE2 | replay FILE: shows, filters or compares traces recorded with --trace, replay only from the command line", 3, readline.PcItem("trace", readline.PcItem("show"), readline.PcItem("diff"), readline.PcItem("replay"))},
+	"ERRORS":        {"errors", " [PEER]: shows the Error and ErrorReply messages received from PEER or from all peers", 1, readline.PcItem("errors", readline.PcItemDynamic(peersListAutoComplete))},
 }
 
 const CMD_TOO_FEW_ARGS = "Invalid line: too few arguments"
 
 const PRIVATE_KEY_PATH = "../private.key"
+const KNOWN_PEERS_PATH = "../known_peers"
+
+// Bumped when the format of the hash cache or how files are split into chunks changes, an older cache is then ignored
+const HASH_CACHE_PATH = "../hash_cache"
+const HASH_CACHE_VERSION = 1
 
 func byteToMsgTypeAsStr(msgType byte) (string, error) {
 	var typeAsString string
@@ -207,6 +373,10 @@ func byteToMsgTypeAsStr(msgType byte) (string, error) {
 		typeAsString = "NoDatum"
 	case NAT_TRAVERSAL:
 		typeAsString = "NatTraversal"
+	case SEALED:
+		typeAsString = "Sealed"
+	case SEALED_REPLY:
+		typeAsString = "SealedReply"
 	default:
 		typeAsString = "Unknown"
 		return typeAsString, fmt.Errorf("unknown message type")
@@ -103,6 +103,32 @@ func checkMsgSignature(msg udpMsg, peerPublicKey []byte) bool {
 	return ok
 }
 
+// Signs data like a message, e.g. a body PUT to the REST server
+func signBytes(data []byte) []byte {
+	hashed := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, privateKey, hashed[:])
+	if err != nil {
+		fmt.Fprint(os.Stderr, "Could not sign data")
+		os.Exit(0)
+	}
+	signature := make([]byte, SIGNATURE_SIZE)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signature
+}
+
+// Returns true if signature is a signature of data made by signBytes with the key peerPublicKey
+func checkBytesSignature(data []byte, signature []byte, peerPublicKey []byte) bool {
+	if len(signature) != SIGNATURE_SIZE || len(peerPublicKey) != KEY_SIZE {
+		return false
+	}
+	hashed := sha256.Sum256(data)
+	var r, s big.Int
+	r.SetBytes(signature[:32])
+	s.SetBytes(signature[32:])
+	return ecdsa.Verify(parsePublicKey(peerPublicKey), hashed[:], &r, &s)
+}
+
 // https://stackoverflow.com/a/41315404
 func encode(privateKey *ecdsa.PrivateKey) string { // publicKey *ecdsa.PublicKey
 	x509Encoded, _ := x509.MarshalECPrivateKey(privateKey)
@@ -1,58 +1,158 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
-	"sync"
 )
 
-func writeBigFileRec(peerName string, hash []byte, path string, thNbr int, depth int, wg *sync.WaitGroup) {
-	if depth == 0 {
-		defer wg.Done()
-	}
-	datumType, datumToCast, _ := DownloadDatum(peerName, hash)
-	if datumType == CHUNK {
-		newDatum := datumToCast.(datumChunk)
-		writeChunk(path+fmt.Sprint(thNbr)+".part", newDatum.Contents)
-	} else {
-		newDatum := datumToCast.(datumTree)
-		for _, chld := range newDatum.ChildrenHashes {
-			writeBigFileRec(peerName, chld, path, thNbr, depth+1, wg)
-		}
-	}
+// A node of a big file being downloaded, slots are kept in file order
+type downloadSlot struct {
+	Hash      []byte
+	Requested bool
+	Done      bool
+	Contents  []byte // Chunk contents once Done
+	NbTries   int
+}
+
+type downloadResult struct {
+	Slot      *downloadSlot
+	DatumType byte
+	Datum     interface{}
+	Err       error
+}
+
+func downloadSlotDatum(peerName string, slot *downloadSlot, results chan downloadResult) {
+	datumType, datum, err := DownloadDatum(peerName, slot.Hash)
+	congestionWindowRelease(peerName)
+	results <- downloadResult{slot, datumType, datum, err}
 }
 
 // TODO Handle peers whose root is not a DIRECTORY datum
 
+// Downloads the big file datum to path with at most the congestion window of peerName GetDatum in flight
+// Chunks are written as soon as all the chunks before them are written, so at most DOWNLOAD_MAX_LOOKAHEAD datums are kept in memory
 func writeBigFile(peerName string, datum datumTree, path string) error {
-	var wg sync.WaitGroup
-	var i int
-	var hash []byte
-	for i, hash = range datum.ChildrenHashes {
-		wg.Add(1)
-		go writeBigFileRec(peerName, hash, path, i, 0, &wg)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	slots := []*downloadSlot{}
+	for _, hash := range datum.ChildrenHashes {
+		slots = append(slots, &downloadSlot{Hash: hash})
 	}
 
-	os.Remove(path)
-	wg.Wait()
-	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	var buff []byte = make([]byte, 1048576)
-	for j := 0; j <= i; j++ {
-		fPart, _ := os.Open(path + fmt.Sprint(j) + ".part")
-		readNb := -1
-		for readNb != 0 {
-			readNb, _ = fPart.Read(buff)
-			f.Write(buff[:readNb])
+	// Never more than DOWNLOAD_MAX_LOOKAHEAD downloads in flight, so the goroutines never block even if we return early
+	results := make(chan downloadResult, DOWNLOAD_MAX_LOOKAHEAD)
+	inFlight := 0
+
+	for {
+		for len(slots) > 0 && slots[0].Done {
+			_, err = f.Write(slots[0].Contents)
+			if err != nil {
+				return err
+			}
+			slots = slots[1:]
+		}
+
+		if len(slots) == 0 {
+			return nil
+		}
+
+		for i := 0; i < len(slots) && i < DOWNLOAD_MAX_LOOKAHEAD; i++ {
+			if slots[i].Requested {
+				continue
+			}
+
+			// If nothing is in flight we must wait for the window, otherwise we would wait for no result
+			if inFlight == 0 {
+				congestionWindowAcquire(peerName)
+			} else if !congestionWindowTryAcquire(peerName) {
+				break
+			}
+
+			slots[i].Requested = true
+			slots[i].NbTries++
+			inFlight++
+			go downloadSlotDatum(peerName, slots[i], results)
+		}
+
+		r := <-results
+		inFlight--
+
+		if r.Err != nil {
+			if grep("^SOFT ", r.Err.Error()) || r.Slot.NbTries >= DOWNLOAD_MAX_TRIES {
+				return fmt.Errorf("downloading %s: %s", path, r.Err.Error())
+			}
+			r.Slot.Requested = false
+			continue
+		}
+
+		var statedHash []byte
+		var children []*downloadSlot
+		switch r.DatumType {
+		case CHUNK:
+			chunk := r.Datum.(datumChunk)
+			statedHash = chunk.StatedHash
+			r.Slot.Contents = chunk.Contents
+			r.Slot.Done = true
+		case TREE:
+			tree := r.Datum.(datumTree)
+			statedHash = tree.StatedHash
+			for _, hash := range tree.ChildrenHashes {
+				children = append(children, &downloadSlot{Hash: hash})
+			}
+		default:
+			return fmt.Errorf("downloading %s: a big file contains a directory", path)
+		}
+
+		if !bytes.Equal(statedHash, r.Slot.Hash) {
+			return fmt.Errorf("downloading %s: peer sent a datum other than the one requested", path)
+		}
+
+		if children != nil { // Replaces the tree by its children
+			i := slices.Index(slots, r.Slot)
+			slots = slices.Replace(slots, i, i+1, children...)
 		}
-		os.Remove(path + fmt.Sprint(j) + ".part")
 	}
-	return nil
+}
+
+// A file or directory of a peer, listed at its path before the peer exported it
+type peerPathEntry struct {
+	Hash     []byte
+	TreePath string          // Path in the tree of the peer, relative to its root
+	Manifest *exportManifest // Of the peer, never nil
+}
+
+// Returns the entries of the directory datum and where they go, the entries of a bucket go into path
+// The shortened names are replaced by the original ones
+// The manifest is not listed
+func (entry peerPathEntry) children(datum datumDirectory, path string) ([]peerPathEntry, []string) {
+	entries := []peerPathEntry{}
+	paths := []string{}
+	for key, value := range datum.Children {
+		if entry.TreePath == "" && key == MANIFEST_NAME && bytes.Equal(value, entry.Manifest.hash) {
+			continue
+		}
+
+		child := peerPathEntry{value, joinTreePath(entry.TreePath, key), entry.Manifest}
+		entries = append(entries, child)
+		if entry.Manifest.isBucket(child.TreePath) {
+			paths = append(paths, path)
+		} else {
+			paths = append(paths, path+"/"+entry.Manifest.originalName(child.TreePath, key))
+		}
+	}
+	return entries, paths
 }
 
 // TODO Handle case where a file becomes a directory (peer updated their tree)
-func downloadRecursive(peerName string, hash []byte, path string) error {
-	datumType, datumToCast, err := DownloadDatum(peerName, hash)
+func downloadRecursive(peerName string, entry peerPathEntry, path string) error {
+	datumType, datumToCast, err := DownloadDatum(peerName, entry.Hash)
 	if err != nil {
 		return err
 	}
@@ -61,17 +161,18 @@ func downloadRecursive(peerName string, hash []byte, path string) error {
 	if datumType == DIRECTORY {
 		datum := datumToCast.(datumDirectory)
 
-		fmt.Println("Creating directory", path)
+		if !entry.Manifest.isBucket(entry.TreePath) {
+			fmt.Println("Creating directory", path)
+		}
 
 		mkdirP(path)
 
-		i := 0
-		for key, value := range datum.Children {
-			err := downloadRecursive(peerName, value, path+"/"+key)
+		children, childrenPaths := entry.children(datum, path)
+		for i, child := range children {
+			err := downloadRecursive(peerName, child, childrenPaths[i])
 			if err != nil {
 				return err
 			}
-			i++
 		}
 	} else if datumType == CHUNK {
 		datum := datumToCast.(datumChunk)
@@ -83,6 +184,8 @@ func downloadRecursive(peerName string, hash []byte, path string) error {
 	} else { // Tree/big file
 		datum := datumToCast.(datumTree)
 
+		fmt.Println("Downloading big file", path)
+
 		os.Remove(path)
 
 		err = writeBigFile(peerName, datum, path)
@@ -94,18 +197,22 @@ func downloadRecursive(peerName string, hash []byte, path string) error {
 	return nil
 }
 
-func getPeerPathHashMapRecursive(peerName string, hash []byte, path string, currentMap map[string][]byte) error {
-	datumType, datumToCast, err := DownloadDatum(peerName, hash)
+func getPeerPathHashMapRecursive(peerName string, entry peerPathEntry, path string, currentMap map[string]peerPathEntry) error {
+	datumType, datumToCast, err := DownloadDatum(peerName, entry.Hash)
 	if err != nil {
 		return err
 	}
-	currentMap[path] = hash
+	// A bucket is listed as its parent directory
+	if !entry.Manifest.isBucket(entry.TreePath) {
+		currentMap[path] = entry
+	}
 
 	if datumType == DIRECTORY {
 		datum := datumToCast.(datumDirectory)
 
-		for key, value := range datum.Children {
-			err = getPeerPathHashMapRecursive(peerName, value, path+"/"+key, currentMap)
+		children, childrenPaths := entry.children(datum, path)
+		for i, child := range children {
+			err = getPeerPathHashMapRecursive(peerName, child, childrenPaths[i], currentMap)
 			if err != nil {
 				return err
 			}
@@ -114,13 +221,18 @@ func getPeerPathHashMapRecursive(peerName string, hash []byte, path string, curr
 	return nil
 }
 
-func getPeerPathHashMap(peerName string) (map[string][]byte, error) {
-	res := make(map[string][]byte)
+// Maps the paths of the files and directories of a peer, as PEER_NAME/PATH, to their entry
+func getPeerPathHashMap(peerName string) (map[string]peerPathEntry, error) {
+	res := make(map[string]peerPathEntry)
 	root, err := GetRootOfPeerUDPThenREST(peerName)
 	if err != nil {
 		return nil, err
 	}
-	err = getPeerPathHashMapRecursive(peerName, root, strings.Replace(peerName, "/", "_", -1), res)
+	manifest, err := getPeerManifest(peerName, root)
+	if err != nil {
+		return nil, err
+	}
+	err = getPeerPathHashMapRecursive(peerName, peerPathEntry{root, "", manifest}, strings.Replace(peerName, "/", "_", -1), res)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// A protocol extension, advertised by setting Bit in the Extensions field of Hello[Reply]
+type extension struct {
+	Bit  uint32 // Exactly one bit set
+	Name string
+}
+
+// Extensions we implement
+// To add an extension: add it here and gate the feature with peerSupportsExtension so that peers without it keep working
+var EXTENSIONS = []extension{EXTENSION_SEALED}
+
+// Protected by a RWMutex
+// Maps a peer name to the Extensions field of the last Hello[Reply] it sent us
+// Peers that never sent us a Hello[Reply] have no key
+var peerExtensions map[string]uint32
+var peerExtensionsMutex *sync.RWMutex
+
+// Extensions field of our Hello[Reply]
+func ourExtensions() uint32 {
+	res := uint32(0)
+	for _, e := range EXTENSIONS {
+		res |= e.Bit
+	}
+	return res
+}
+
+func peerExtensionsSet(peerName string, extensions uint32) {
+	peerExtensionsMutex.Lock()
+	defer peerExtensionsMutex.Unlock()
+
+	peerExtensions[peerName] = extensions
+}
+
+// Returns the extensions advertised by peerName, false if it never sent us a Hello[Reply]
+func peerExtensionsGet(peerName string) (uint32, bool) {
+	peerExtensionsMutex.RLock()
+	defer peerExtensionsMutex.RUnlock()
+
+	extensions, found := peerExtensions[peerName]
+	return extensions, found
+}
+
+// Returns true if both peerName and us support ext
+func peerSupportsExtension(peerName string, ext extension) bool {
+	theirs, found := peerExtensionsGet(peerName)
+	return found && theirs&ourExtensions()&ext.Bit != 0
+}
+
+// Names of the extensions set in bits, unknown bits are shown by their index
+func extensionsToString(bits uint32) string {
+	if bits == 0 {
+		return "none"
+	}
+
+	names := []string{}
+	for i := 0; i < 8*HELLO_EXTENSIONS_SIZE; i++ {
+		bit := uint32(1) << i
+		if bits&bit == 0 {
+			continue
+		}
+
+		name := fmt.Sprintf("unknown bit %d", i)
+		for _, e := range EXTENSIONS {
+			if e.Bit == bit {
+				name = e.Name
+			}
+		}
+		names = append(names, name)
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// Describes the extensions of peerName for lspeers, empty if we never exchanged Hellos with peerName
+func peerExtensionsDescription(peerName string) string {
+	extensions, found := peerExtensionsGet(peerName)
+	if !found {
+		return ""
+	}
+	return " (extensions: " + extensionsToString(extensions) + ")"
+}
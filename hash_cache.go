@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+)
+
+// Hashes of a file saved in HASH_CACHE_PATH, valid while the file has the same size, modification time and inode
+type hashCacheEntry struct {
+	Size    int64
+	ModTime int64 // Unix nanoseconds
+	Inode   uint64
+
+	// Hashes of the nodes of the file, each node before its children as given by preOrder
+	Hashes []byte
+}
+
+type hashCache struct {
+	Version int
+	Entries map[string]hashCacheEntry // By path
+}
+
+// Returns the entries of HASH_CACHE_PATH, none if it is missing, invalid or of another version
+func loadHashCache() map[string]hashCacheEntry {
+	contents, err := os.ReadFile(HASH_CACHE_PATH)
+	if err != nil {
+		return nil
+	}
+
+	cache := hashCache{}
+	err = gob.NewDecoder(bytes.NewReader(contents)).Decode(&cache)
+	if err != nil {
+		LOGGING_FUNC("Ignoring the invalid hash cache:", err)
+		return nil
+	}
+	if cache.Version != HASH_CACHE_VERSION {
+		LOGGING_FUNC("Ignoring the hash cache of version", cache.Version)
+		return nil
+	}
+	return cache.Entries
+}
+
+// Saves the hashes of files, writing to a temporary file then renaming it so that a crash doesn't leave a truncated cache
+func saveHashCache(files map[string]*merkleTreeNode) error {
+	cache := hashCache{Version: HASH_CACHE_VERSION, Entries: make(map[string]hashCacheEntry, len(files))}
+	for path, node := range files {
+		entry := hashCacheEntry{Size: node.Size, ModTime: node.ModTime.UnixNano(), Inode: node.Inode}
+		for _, n := range node.preOrder() {
+			entry.Hashes = append(entry.Hashes, n.Hash...)
+		}
+		cache.Entries[path] = entry
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(cache)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := HASH_CACHE_PATH + ".tmp"
+	err = os.WriteFile(tmpPath, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, HASH_CACHE_PATH)
+}
+
+// Sets the hashes of the chunks and internal nodes of the file of node from the entry if it is still valid
+// Returns false if the file has to be hashed
+func (entry hashCacheEntry) restore(node *merkleTreeNode) bool {
+	if entry.Size != node.Size || entry.ModTime != node.ModTime.UnixNano() || entry.Inode != node.Inode {
+		return false
+	}
+
+	nodes := node.preOrder()
+	if len(entry.Hashes) != len(nodes)*HASH_SIZE {
+		return false
+	}
+	for i, n := range nodes {
+		n.Hash = entry.Hashes[i*HASH_SIZE : (i+1)*HASH_SIZE : (i+1)*HASH_SIZE]
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress of a call to hashFiles, updated by its workers
+type hashProgress struct {
+	TotalFiles  int
+	TotalBytes  int64
+	HashedFiles atomic.Int64
+	HashedBytes atomic.Int64
+}
+
+// Hashes files on a pool of one worker per CPU, each file being read sequentially by a single worker
+// Shows the progress every HASH_PROGRESS_PERIOD until it ends, returns the first error once every worker stopped
+func hashFiles(files []*merkleTreeNode) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	// The biggest files first so that a big file doesn't end last on a single worker
+	files = slices.Clone(files)
+	slices.SortFunc(files, func(a, b *merkleTreeNode) int { return cmp.Compare(b.Size, a.Size) })
+
+	progress := &hashProgress{TotalFiles: len(files)}
+	for _, f := range files {
+		progress.TotalBytes += f.Size
+	}
+
+	jobs := make(chan *merkleTreeNode)
+	errs := make(chan error, len(files))
+	wg := sync.WaitGroup{}
+	for i := 0; i < min(runtime.NumCPU(), len(files)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for node := range jobs {
+				err := node.hashFile(progress)
+				if err != nil {
+					errs <- err
+				}
+				progress.HashedFiles.Add(1)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go progress.show(done)
+
+	for _, f := range files {
+		jobs <- f
+	}
+	close(jobs)
+	wg.Wait()
+	close(done)
+
+	close(errs)
+	return <-errs // nil if there was no error
+}
+
+// Prints the progress every HASH_PROGRESS_PERIOD until done is closed, then how long it took if it was printed
+func (progress *hashProgress) show(done chan struct{}) {
+	start := time.Now()
+	ticker := time.NewTicker(HASH_PROGRESS_PERIOD)
+	defer ticker.Stop()
+
+	shown := false
+	for {
+		select {
+		case <-ticker.C:
+			shown = true
+			fmt.Fprintf(os.Stderr, "Hashing %s: %d/%d files, %d%% of %d bytes\n", SHARED_FILES_DIR, progress.HashedFiles.Load(), progress.TotalFiles, progress.percent(), progress.TotalBytes)
+		case <-done:
+			if shown {
+				fmt.Fprintf(os.Stderr, "Hashed %d files of %s in %v\n", progress.TotalFiles, SHARED_FILES_DIR, time.Since(start).Round(time.Millisecond))
+			}
+			return
+		}
+	}
+}
+
+func (progress *hashProgress) percent() int64 {
+	if progress.TotalBytes == 0 {
+		return 100
+	}
+	return progress.HashedBytes.Load() * 100 / progress.TotalBytes
+}
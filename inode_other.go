@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Inodes are not available, a file is then recognized by its size and modification time only
+func fileInode(fi os.FileInfo) uint64 {
+	return 0
+}
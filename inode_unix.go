@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the inode of the file, so that a file replaced by another one with the same size and modification time is hashed again
+func fileInode(fi os.FileInfo) uint64 {
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(stat.Ino)
+}
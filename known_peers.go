@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What to do when the REST server gives a key different from the one pinned for a peer
+const (
+	KEY_POLICY_REJECT = "reject" // Keep trusting the pinned key
+	KEY_POLICY_ACCEPT = "accept" // Pin the new key
+	KEY_POLICY_ASK    = "ask"    // Keep trusting the pinned key until the user runs trust PEER
+)
+
+// Set by --key-policy
+var KEY_POLICY = KEY_POLICY_ASK
+
+// A key pinned the first time we got it (trust on first use)
+// Peers without a key are not pinned, and a pinned peer whose key disappears keeps its pinned key as we may just have failed to get it
+type knownPeer struct {
+	Key        []byte
+	PendingKey []byte // Different key given by the REST server, nil if there is none
+	PendingAt  time.Time
+}
+
+// Protected by a Mutex
+// Maps a peer name to its pinned key, saved in KNOWN_PEERS_PATH
+var knownPeers map[string]*knownPeer = make(map[string]*knownPeer)
+var knownPeersMutex = &sync.Mutex{}
+
+// SHA256:base64 of the key like OpenSSH, "none" for an empty key
+func keyFingerprint(key []byte) string {
+	if len(key) == 0 {
+		return "none"
+	}
+	hash := sha256.Sum256(key)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+}
+
+// Each line is FINGERPRINT KEY_IN_HEX PEER_NAME, the name is last as it may contain spaces
+// The fingerprint is checked against the key so that a hand-edited file can't silently pin something else
+func loadKnownPeers() error {
+	f, err := os.Open(KNOWN_PEERS_PATH)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: expected FINGERPRINT KEY PEER_NAME", KNOWN_PEERS_PATH, lineNumber)
+		}
+
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != KEY_SIZE {
+			return fmt.Errorf("%s:%d: invalid key", KNOWN_PEERS_PATH, lineNumber)
+		}
+		if keyFingerprint(key) != fields[0] {
+			return fmt.Errorf("%s:%d: the fingerprint of %s doesn't match its key", KNOWN_PEERS_PATH, lineNumber, fields[2])
+		}
+
+		knownPeers[fields[2]] = &knownPeer{Key: key}
+	}
+
+	return scanner.Err()
+}
+
+// Writes to a temporary file then renames it so that a crash doesn't lose the pins
+// Assumes that knownPeersMutex is locked
+func saveKnownPeers() {
+	names := make([]string, 0, len(knownPeers))
+	for name := range knownPeers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	contents := ""
+	for _, name := range names {
+		key := knownPeers[name].Key
+		contents += keyFingerprint(key) + " " + hex.EncodeToString(key) + " " + name + "\n"
+	}
+
+	tmpPath := KNOWN_PEERS_PATH + ".tmp"
+	err := os.WriteFile(tmpPath, []byte(contents), 0o600)
+	if err == nil {
+		err = os.Rename(tmpPath, KNOWN_PEERS_PATH)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't save known peers:", err)
+	}
+}
+
+// Returns the key to trust for peerName given the key restKey from the REST server
+// Pins restKey if the peer is unknown, otherwise applies KEY_POLICY if it differs from the pinned key
+// An empty restKey is never pinned, the pinned key if any is kept
+func knownPeersCheck(peerName string, restKey []byte) []byte {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	known, found := knownPeers[peerName]
+	if len(restKey) == 0 && found {
+		return known.Key
+	} else if len(restKey) == 0 {
+		return restKey
+	} else if !found {
+		LOGGING_FUNC("Pinning key", keyFingerprint(restKey), "of", peerName)
+		knownPeers[peerName] = &knownPeer{Key: restKey}
+		saveKnownPeers()
+		return restKey
+	}
+
+	if string(known.Key) == string(restKey) {
+		return restKey
+	}
+
+	fmt.Fprintf(os.Stderr, "WARNING: THE KEY OF %s CHANGED, someone may be impersonating it or the REST server\n", peerName)
+	fmt.Fprintf(os.Stderr, "\tpinned key: %s\n\tnew key:    %s\n", keyFingerprint(known.Key), keyFingerprint(restKey))
+
+	switch KEY_POLICY {
+	case KEY_POLICY_ACCEPT:
+		fmt.Fprintln(os.Stderr, "\tpolicy is accept, pinning the new key")
+		known.Key = restKey
+		known.PendingKey = nil
+		saveKnownPeers()
+		return restKey
+	case KEY_POLICY_ASK:
+		// Not CMD_MAP["TRUST"].Name, CMD_MAP depends on this function through its completers
+		fmt.Fprintf(os.Stderr, "\tstill trusting the pinned key, run \"trust %s\" to pin the new one\n", peerName)
+		known.PendingKey = restKey
+		known.PendingAt = time.Now()
+	default:
+		fmt.Fprintln(os.Stderr, "\tpolicy is reject, still trusting the pinned key")
+	}
+
+	return known.Key
+}
+
+// A lookup of the key of a peer in progress, other lookups of the same key wait for it
+type peerKeyLookup struct {
+	done chan struct{} // Closed when the lookup is over, key is then set
+	key  []byte
+}
+
+// The REST server is not asked for the key again before RetryAt
+type peerKeyFailure struct {
+	RetryAt time.Time
+	Wait    time.Duration
+}
+
+// Returns the key of peerName, from the REST server the first time and checked against the pinned one
+// The REST server is asked without holding peerKeysMutex, by a single goroutine at a time
+// If it can't be reached the pinned key is used, and it is asked again after a backoff (see PEER_KEY_RETRY_INITIAL_WAIT)
+func peerKeysGet(peerName string) []byte {
+	peerKeysMutex.Lock()
+	v, f := peerKeys[peerName]
+	if f {
+		peerKeysMutex.Unlock()
+		return v
+	}
+
+	failure, failed := peerKeyFailures[peerName]
+	if failed && time.Now().Before(failure.RetryAt) {
+		peerKeysMutex.Unlock()
+		return knownPeersCheck(peerName, nil)
+	}
+
+	lookup, inProgress := peerKeyLookups[peerName]
+	if inProgress {
+		peerKeysMutex.Unlock()
+		<-lookup.done
+		return lookup.key
+	}
+	lookup = &peerKeyLookup{done: make(chan struct{})}
+	peerKeyLookups[peerName] = lookup
+	peerKeysMutex.Unlock()
+
+	restKey, err := restGetKey(peerName)
+	if err != nil {
+		LOGGING_FUNC("Couldn't get the key of", peerName, "from the REST server:", err)
+		lookup.key = knownPeersCheck(peerName, nil)
+	} else {
+		lookup.key = knownPeersCheck(peerName, restKey)
+	}
+
+	peerKeysMutex.Lock()
+	delete(peerKeyLookups, peerName)
+	if err != nil {
+		wait := PEER_KEY_RETRY_INITIAL_WAIT
+		if failed {
+			wait = min(2*failure.Wait, PEER_KEY_RETRY_MAX_WAIT)
+		}
+		peerKeyFailuresCleanup()
+		peerKeyFailures[peerName] = peerKeyFailure{time.Now().Add(wait), wait}
+	} else {
+		delete(peerKeyFailures, peerName)
+		peerKeys[peerName] = lookup.key
+	}
+	peerKeysMutex.Unlock()
+
+	close(lookup.done)
+	return lookup.key
+}
+
+// Removes the failures whose backoff is over for long enough that the next one would start again from PEER_KEY_RETRY_INITIAL_WAIT
+// Assumes that peerKeysMutex is locked
+func peerKeyFailuresCleanup() {
+	for k, f := range peerKeyFailures {
+		if time.Since(f.RetryAt) > PEER_KEY_RETRY_MAX_WAIT {
+			delete(peerKeyFailures, k)
+		}
+	}
+}
+
+// Pins the pending key of peerName, or the current key given by the REST server if there is none
+func trustPeerKey(peerName string) error {
+	knownPeersMutex.Lock()
+	known, found := knownPeers[peerName]
+	var key []byte
+	if found && known.PendingKey != nil {
+		key = known.PendingKey
+	}
+	knownPeersMutex.Unlock()
+
+	if key == nil {
+		var err error
+		key, err = restGetKey(peerName)
+		if err != nil {
+			return err
+		}
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("no key to pin for %s, the REST server has none", peerName)
+	}
+
+	knownPeersMutex.Lock()
+	knownPeers[peerName] = &knownPeer{Key: key}
+	saveKnownPeers()
+	knownPeersMutex.Unlock()
+
+	peerKeysMutex.Lock()
+	peerKeys[peerName] = key
+	delete(peerKeyFailures, peerName)
+	peerKeysMutex.Unlock()
+
+	fmt.Println("Pinned key", keyFingerprint(key), "of", peerName)
+	return nil
+}
+
+// Removes the pin of peerName, its next key is pinned on first use
+func forgetPeerKey(peerName string) error {
+	knownPeersMutex.Lock()
+	_, found := knownPeers[peerName]
+	if found {
+		delete(knownPeers, peerName)
+		saveKnownPeers()
+	}
+	knownPeersMutex.Unlock()
+
+	if !found {
+		return fmt.Errorf("no key pinned for %s", peerName)
+	}
+
+	peerKeysMutex.Lock()
+	delete(peerKeys, peerName)
+	peerKeysMutex.Unlock()
+	return nil
+}
+
+func printKnownPeers() {
+	knownPeersMutex.Lock()
+	defer knownPeersMutex.Unlock()
+
+	names := make([]string, 0, len(knownPeers))
+	for name := range knownPeers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("Policy when a key changes:", KEY_POLICY)
+	for _, name := range names {
+		known := knownPeers[name]
+		fmt.Printf("%s %s\n", name, keyFingerprint(known.Key))
+		if known.PendingKey != nil {
+			fmt.Printf("\tCHANGED to %s %s ago, run %s %s to pin it\n", keyFingerprint(known.PendingKey), time.Since(known.PendingAt).Round(time.Second), CMD_MAP["TRUST"].Name, name)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// An empty key from the REST server is never pinned, so known_peers can always be loaded again
+func TestKnownPeersEmptyKey(t *testing.T) {
+	chdirToTestRun(t, nil)
+	setTestKeys(t)
+	knownPeers = make(map[string]*knownPeer)
+	previousPolicy := KEY_POLICY
+	KEY_POLICY = KEY_POLICY_ACCEPT
+	defer func() { KEY_POLICY = previousPolicy }()
+
+	if key := knownPeersCheck("new", []byte{}); len(key) != 0 {
+		t.Fatalf("got key %x for a peer without key", key)
+	}
+	if _, found := knownPeers["new"]; found {
+		t.Fatal("empty key pinned")
+	}
+
+	pinned := publicKeyToHexaString()
+	knownPeersCheck("pinned", pinned)
+	if key := knownPeersCheck("pinned", []byte{}); !bytes.Equal(key, pinned) {
+		t.Fatalf("got key %x instead of the pinned one after an empty lookup", key)
+	}
+
+	knownPeers = make(map[string]*knownPeer)
+	err := loadKnownPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(knownPeers) != 1 || !bytes.Equal(knownPeers["pinned"].Key, pinned) {
+		t.Fatalf("loaded %v, expected only the key of pinned", knownPeers)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"time"
+)
+
+// What we know about the traffic with an address
+type addrLiveness struct {
+	Addr         *net.UDPAddr
+	LastSeen     time.Time // Last message received from Addr
+	LastActivity time.Time // Last message other than Hello, HelloReply and NoOp sent to or received from Addr
+	LastHello    time.Time // Last Hello received from Addr
+	VerifiedName string    // Peer whose signed Hello or HelloReply we verified from Addr, "" if none
+}
+
+// Addresses that sent nothing for this long are removed from peers, set by --peer-ttl
+var PEER_ADDRESS_TTL = DEFAULT_PEER_ADDRESS_TTL
+
+// Assumes that n.addrLivenessesMutex is locked
+func (n *udpNode) addrLivenessGet(addr *net.UDPAddr) *addrLiveness {
+	liveness, found := n.addrLivenesses[addr.String()]
+	if !found {
+		liveness = &addrLiveness{Addr: addr}
+		n.addrLivenesses[addr.String()] = liveness
+	}
+	return liveness
+}
+
+func msgIsKeepAlive(msgType byte) bool {
+	return msgType == HELLO || msgType == HELLO_REPLY || msgType == NOOP
+}
+
+func (n *udpNode) livenessOnReceive(addr *net.UDPAddr, msgType byte) {
+	n.addrLivenessesMutex.Lock()
+	defer n.addrLivenessesMutex.Unlock()
+
+	liveness := n.addrLivenessGet(addr)
+	liveness.LastSeen = time.Now()
+	if !msgIsKeepAlive(msgType) {
+		liveness.LastActivity = liveness.LastSeen
+	}
+	if msgType == HELLO {
+		liveness.LastHello = liveness.LastSeen
+	}
+}
+
+func (n *udpNode) livenessOnSend(addr *net.UDPAddr, msgType byte) {
+	if msgIsKeepAlive(msgType) {
+		return
+	}
+
+	n.addrLivenessesMutex.Lock()
+	defer n.addrLivenessesMutex.Unlock()
+
+	n.addrLivenessGet(addr).LastActivity = time.Now()
+}
+
+// Called when addr sent a Hello or HelloReply signed by the key of peerName
+func (n *udpNode) livenessOnVerifiedHello(addr *net.UDPAddr, peerName string) {
+	n.addrLivenessesMutex.Lock()
+	defer n.addrLivenessesMutex.Unlock()
+
+	n.addrLivenessGet(addr).VerifiedName = peerName
+}
+
+// Called when an address is added to peers, we just received something from it
+func (n *udpNode) livenessOnPeersAdd(addr *net.UDPAddr) {
+	n.addrLivenessesMutex.Lock()
+	defer n.addrLivenessesMutex.Unlock()
+
+	liveness := n.addrLivenessGet(addr)
+	if liveness.LastSeen.IsZero() {
+		liveness.LastSeen = time.Now()
+	}
+}
+
+// As the main peer we don't keep peers alive, a peer stays registered as long as it sends us Hellos
+func livenessLastHeard(liveness addrLiveness) time.Time {
+	if mainPeerOn {
+		return liveness.LastHello
+	}
+	return liveness.LastSeen
+}
+
+// Returns a copy of the liveness of addr, false if we never exchanged with addr
+func (n *udpNode) livenessGet(addr *net.UDPAddr) (addrLiveness, bool) {
+	n.addrLivenessesMutex.Lock()
+	defer n.addrLivenessesMutex.Unlock()
+
+	liveness, found := n.addrLivenesses[addr.String()]
+	if !found {
+		return addrLiveness{}, false
+	}
+	return *liveness, true
+}
+
+// Every LIVENESS_CHECK_PERIOD:
+//   - removes from peers the addresses silent for PEER_ADDRESS_TTL
+//   - sends Hello to the addresses with activity during KEEP_ALIVE_ACTIVITY_WINDOW that were silent for KEEP_ALIVE_PERIOD, so that NAT mappings stay open
+//
+// SERVER_PEER_NAME is maintained by keepAliveMainPeer and our own name is never removed
+func (n *udpNode) keepAlivePeers() {
+	for {
+		time.Sleep(LIVENESS_CHECK_PERIOD)
+
+		n.peersMutex.RLock()
+		peersCopy := make(map[string][]*net.UDPAddr)
+		for k, v := range n.peers {
+			peersCopy[k] = slices.Clone(v)
+		}
+		n.peersMutex.RUnlock()
+
+		for peerName, addresses := range peersCopy {
+			if peerName == SERVER_PEER_NAME || peerName == n.Name {
+				continue
+			}
+
+			for _, a := range addresses {
+				liveness, _ := n.livenessGet(a)
+
+				if time.Since(livenessLastHeard(liveness)) > PEER_ADDRESS_TTL {
+					LOGGING_FUNC("Removing", a.String(), "of", peerName, "from peers: nothing received for", PEER_ADDRESS_TTL)
+					n.peersRemoveAddr(peerName, a)
+				} else if !mainPeerOn && time.Since(liveness.LastActivity) < KEEP_ALIVE_ACTIVITY_WINDOW && time.Since(liveness.LastSeen) >= KEEP_ALIVE_PERIOD {
+					LOGGING_FUNC("Keeping alive", a.String(), "of", peerName)
+					go n.sendToAddrAndReceiveMsgWithReemissions(a, createHello(n.Name))
+				}
+			}
+		}
+
+		// Forgets the addresses that aren't in peers and were silent for PEER_ADDRESS_TTL
+		n.addrLivenessesMutex.Lock()
+		for k, v := range n.addrLivenesses {
+			if time.Since(v.LastSeen) > PEER_ADDRESS_TTL && time.Since(v.LastActivity) > PEER_ADDRESS_TTL && n.peersGetKeyFromVal(v.Addr) == "" {
+				delete(n.addrLivenesses, k)
+			}
+		}
+		n.addrLivenessesMutex.Unlock()
+	}
+}
+
+func (n *udpNode) printLiveness() {
+	n.peersMutex.RLock()
+	peerNames := []string{}
+	peersCopy := make(map[string][]*net.UDPAddr)
+	for k, v := range n.peers {
+		peerNames = append(peerNames, k)
+		peersCopy[k] = slices.Clone(v)
+	}
+	n.peersMutex.RUnlock()
+
+	sort.Strings(peerNames)
+
+	formatAgo := func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Round(time.Second).String() + " ago"
+	}
+
+	for _, peerName := range peerNames {
+		fmt.Println(peerName + ":")
+		for _, a := range peersCopy[peerName] {
+			liveness, _ := n.livenessGet(a)
+
+			state := "idle"
+			if peerName == SERVER_PEER_NAME {
+				state = "main peer, kept alive"
+			} else if peerName == n.Name {
+				state = "ourselves"
+			} else if mainPeerOn {
+				state = "registered, last Hello " + formatAgo(liveness.LastHello)
+			} else if time.Since(liveness.LastActivity) < KEEP_ALIVE_ACTIVITY_WINDOW {
+				state = "active, kept alive"
+			}
+
+			fmt.Printf("\t%s: last seen %s, last activity %s, %s", a.String(), formatAgo(liveness.LastSeen), formatAgo(liveness.LastActivity), state)
+			if peerName != SERVER_PEER_NAME && peerName != n.Name {
+				fmt.Printf(", expires in %s", (PEER_ADDRESS_TTL - time.Since(livenessLastHeard(liveness))).Round(time.Second))
+			}
+			fmt.Println()
+		}
+	}
+}
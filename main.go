@@ -1,20 +1,97 @@
 package main
 
 import (
+	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// True if --server was given
+var serverAddressSet = false
+
+// Parses the options before the command to run and returns the command to run
+func parseOptions(args []string) []string {
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		switch args[0] {
+		case "--debug":
+			DEBUG = true
+			LOGGING_FUNC("Debugging")
+		case "--peer-ttl":
+			if len(args) < 2 {
+				fmt.Fprintln(os.Stderr, "--peer-ttl requires a duration e.g. 180s")
+				os.Exit(1)
+			}
+			ttl, err := time.ParseDuration(args[1])
+			if err != nil || ttl <= 0 {
+				fmt.Fprintln(os.Stderr, "Invalid duration for --peer-ttl:", args[1])
+				os.Exit(1)
+			}
+			PEER_ADDRESS_TTL = ttl
+			args = args[1:]
+		case "--key-policy":
+			if len(args) < 2 || (args[1] != KEY_POLICY_REJECT && args[1] != KEY_POLICY_ACCEPT && args[1] != KEY_POLICY_ASK) {
+				fmt.Fprintln(os.Stderr, "--key-policy requires reject, accept or ask")
+				os.Exit(1)
+			}
+			KEY_POLICY = args[1]
+			args = args[1:]
+		case "--server":
+			if len(args) < 2 || !(strings.HasPrefix(args[1], "http://") || strings.HasPrefix(args[1], "https://")) {
+				fmt.Fprintln(os.Stderr, "--server requires a URL e.g. http://192.168.1.5:8080")
+				os.Exit(1)
+			}
+			SERVER_ADDRESS = strings.TrimSuffix(args[1], "/")
+			serverAddressSet = true
+			args = args[1:]
+		case "--port":
+			if len(args) < 2 {
+				fmt.Fprintln(os.Stderr, "--port requires a UDP port")
+				os.Exit(1)
+			}
+			port, err := strconv.Atoi(args[1])
+			if err != nil || port <= 0 || port > 65535 {
+				fmt.Fprintln(os.Stderr, "Invalid port for --port:", args[1])
+				os.Exit(1)
+			}
+			UDP_LISTEN_PORT = port
+			args = args[1:]
+		case "--name":
+			if len(args) < 2 || args[1] == "" {
+				fmt.Fprintln(os.Stderr, "--name requires a peer name")
+				os.Exit(1)
+			}
+			OUR_PEER_NAME = args[1]
+			args = args[1:]
+		case "--split-dirs":
+			SPLIT_LARGE_DIRECTORIES = true
+		case "--trace":
+			if len(args) < 2 {
+				fmt.Fprintln(os.Stderr, "--trace requires a file")
+				os.Exit(1)
+			}
+			err := openTrace(args[1])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Couldn't open trace file:", err)
+				os.Exit(1)
+			}
+			args = args[1:]
+		default:
+			fmt.Fprintln(os.Stderr, "Unknown option", args[0])
+			os.Exit(1)
+		}
+		args = args[1:]
+	}
+
+	return args
+}
+
 func main() {
 	// TODO Here check that current dir is the root of the project
 
-	var cmdToRun []string
-	if len(os.Args) > 1 && os.Args[1] == "--debug" {
-		DEBUG = true
-		LOGGING_FUNC("Debugging")
-		cmdToRun = os.Args[2:]
-	} else {
-		cmdToRun = os.Args[1:]
-	}
+	cmdToRun := parseOptions(os.Args[1:])
 
 	err := mkdirP(DOWNLOAD_DIR)
 	checkErr(err)
@@ -23,19 +100,36 @@ func main() {
 
 	setKeys()
 
+	err = loadKnownPeers()
+	checkErrPanic(err)
+
 	initOurPeerName()
 
-	// TODO Check at start that any subdirectory of SHARED_FILES_DIR has at most 16 children
 	err = mkdirP(SHARED_FILES_DIR)
 	checkErr(err)
 
-	err = exportMerkleTree()
-	checkErr(err)
+	// Trace files are read offline, a replay uses its own in-memory network and answers from our tree
+	if len(cmdToRun) > 0 && cmdToRun[0] == CMD_MAP["TRACE"].Name {
+		_, err = exportMerkleTree()
+		checkErr(err)
+		os.Exit(runTraceCommand(cmdToRun[1:]))
+	}
+
+	// The main peer has no main peer to keep alive or REST server to publish to
+	if len(cmdToRun) > 0 && cmdToRun[0] == CMD_MAP["SERVE_REST"].Name {
+		os.Exit(serveRest(cmdToRun[1:]))
+	}
 
 	checkErrPanic(initUdp())
 
-	go listenAndRespond()
-	go keepAliveMainPeer()
+	go ourNode.listenAndRespond()
+	go ourNode.keepAliveMainPeer()
+	go ourNode.keepAlivePeers()
+	go restPublisher()
+	go watchSharedFiles()
+
+	// Our key is published while our files are hashed, our root once they are
+	requestRestPublish()
 
 	if len(cmdToRun) > 0 {
 		runLine(cmdToRun)
@@ -43,3 +137,36 @@ func main() {
 		mainMenu()
 	}
 }
+
+// serve-rest [LISTEN_ADDR]: we become the main peer, our REST client uses our own server unless --server was given
+func serveRest(args []string) int {
+	listenAddr := REST_SERVER_DEFAULT_LISTEN_ADDR
+	if len(args) > 0 {
+		listenAddr = args[0]
+	}
+
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid listen address", listenAddr+":", err)
+		return 1
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if !serverAddressSet {
+		SERVER_ADDRESS = "http://" + net.JoinHostPort(host, port)
+	}
+	OUR_PEER_NAME = SERVER_PEER_NAME
+	restServerOn = true
+	mainPeerOn = true
+
+	checkErrPanic(initUdp())
+
+	go ourNode.listenAndRespond()
+	go ourNode.keepAlivePeers()
+	go watchSharedFiles()
+
+	err = runRestServer(listenAddr)
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
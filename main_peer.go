@@ -0,0 +1,44 @@
+package main
+
+import "fmt"
+
+// True when we play the role of jch.irif.fr (serve-rest mode)
+// The peers that send us Hello are registered in peers and forgotten after PEER_ADDRESS_TTL without Hello
+var mainPeerOn = false
+
+// Peers look up the main peer by its name, another peer can't register it
+func mainPeerCheckHello(peerName string) error {
+	if peerName == OUR_PEER_NAME {
+		return fmt.Errorf("%s is the name of the main peer", peerName)
+	}
+	return nil
+}
+
+// Forwards the NatTraversalRequest of a registered peer as a NatTraversal to the registered peer it names
+// The NatTraversal carries the address from which we received the request, NatTraversalRequest has no reply
+// Only registered addresses are relayed to, so that we can't be used to send datagrams to anyone
+func (n *udpNode) mainPeerRelayNatTraversal(receivedMsg addrUdpMsg, requesterName string) {
+	if requesterName == "" {
+		n.replyWithError(receivedMsg, "send Hello before a NatTraversalRequest")
+		return
+	}
+
+	// The body size was checked by checkMsgIntegrity
+	targetAddr, _ := byteSliceToUDPAddr(receivedMsg.Msg.Body)
+	targetName := n.peersGetKeyFromVal(targetAddr)
+	if targetName == "" || targetName == n.Name {
+		n.replyWithError(receivedMsg, "no registered peer at "+targetAddr.String())
+		return
+	}
+	if !n.udpAddrIsReachable(targetAddr) {
+		n.replyWithError(receivedMsg, "we have no socket to reach "+targetAddr.String())
+		return
+	}
+
+	LOGGING_FUNC("Relaying NAT traversal from", requesterName, receivedMsg.Addr.String(), "to", targetName, targetAddr.String())
+
+	err := n.simpleSendMsgToAddr(targetAddr, createMsg(NAT_TRAVERSAL, udpAddrToByteSlice(receivedMsg.Addr)))
+	if err != nil {
+		LOGGING_FUNC("Couldn't relay NAT traversal to", targetAddr.String()+":", err)
+	}
+}
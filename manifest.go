@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// Set by --split-dirs
+// Peers reject a directory with more than MAX_DIRECTORY_CHILDREN entries, it is then split into buckets when exporting
+var SPLIT_LARGE_DIRECTORIES = false
+
+// Published at the root of our tree as MANIFEST_NAME so that our downloader can undo what was changed to export SHARED_FILES_DIR
+type exportManifest struct {
+	// Paths in the tree, relative to its root, of the directories added to split a directory with too many entries
+	// The entries of a bucket belong to its parent
+	Buckets []string `json:",omitempty"`
+
+	// Maps the path in the tree of a file or directory whose name is longer than FILENAME_MAX_SIZE to its name
+	Names map[string]string `json:",omitempty"`
+
+	// Not published
+	hash    []byte          // Of the manifest datum of a peer
+	buckets map[string]bool // Buckets as a set
+}
+
+func (m *exportManifest) isEmpty() bool {
+	return len(m.Buckets) == 0 && len(m.Names) == 0
+}
+
+// Returns the name of the entry at treePath before it was exported, name if it was not changed
+// A name that can't be a file name is ignored, it could make us write outside of the download directory
+func (m *exportManifest) originalName(treePath string, name string) string {
+	original, found := m.Names[treePath]
+	if !found || original == "" || original == "." || original == ".." || strings.ContainsAny(original, "/\x00") {
+		return name
+	}
+	return original
+}
+
+func (m *exportManifest) isBucket(treePath string) bool {
+	if m.buckets == nil {
+		m.buckets = make(map[string]bool)
+		for _, b := range m.Buckets {
+			m.buckets[b] = true
+		}
+	}
+	return m.buckets[treePath]
+}
+
+func joinTreePath(dirTreePath string, name string) string {
+	if dirTreePath == "" {
+		return name
+	}
+	return dirTreePath + "/" + name
+}
+
+// Reports every directory under root that peers would reject and every name that is reserved for our exports
+// Also returns true if exporting root shortens names or, with --split-dirs, splits directories, our tree then has a manifest
+// Decided from the names only, like bucketsOf, so that the root knows whether to keep room for the manifest before walking its entries
+func validateSharedFiles(root string) ([]string, bool) {
+	problems := []string{}
+	needsManifest := false
+	dirs := []string{}
+	nbEntries := make(map[string]int)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			problems = append(problems, err.Error())
+			return nil
+		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		if path == root {
+			return nil
+		}
+
+		nbEntries[filepath.Dir(path)]++
+		if strings.HasPrefix(d.Name(), RESERVED_NAME_PREFIX) {
+			problems = append(problems, fmt.Sprintf("%s: names starting with %s are reserved for our exports", path, RESERVED_NAME_PREFIX))
+		}
+		if len(d.Name()) > FILENAME_MAX_SIZE {
+			needsManifest = true
+		}
+		return nil
+	})
+
+	for _, dir := range dirs {
+		if nbEntries[dir] > MAX_DIRECTORY_CHILDREN {
+			problems = append(problems, fmt.Sprintf("%s: %d entries but peers accept at most %d", dir, nbEntries[dir], MAX_DIRECTORY_CHILDREN))
+			needsManifest = needsManifest || SPLIT_LARGE_DIRECTORIES
+		}
+	}
+	return problems, needsManifest
+}
+
+// Returns the path of the bucket of each of the names of a directory, relative to it, "" for no bucket
+// Decided from the names only so that the paths in the tree are known before walking the entries
+// With --split-dirs, a directory with too many entries is split
+// The root keeps room for the manifest if it has one, even without --split-dirs: if it is full all its entries go into a single bucket, split in turn
+func bucketsOf(names []string, keepRoomForManifest bool) []string {
+	res := make([]string, len(names))
+	indices := make([]int, len(names))
+	for i := range indices {
+		indices[i] = i
+	}
+
+	if keepRoomForManifest && len(names) >= MAX_DIRECTORY_CHILDREN {
+		splitNames(names, indices, "", BUCKET_PREFIX, res)
+	} else if SPLIT_LARGE_DIRECTORIES && len(names) > MAX_DIRECTORY_CHILDREN {
+		splitNames(names, indices, "", "", res)
+	}
+	return res
+}
+
+// Returns the names of the entries of a directory in our tree
+// A name longer than FILENAME_MAX_SIZE becomes a prefix of it followed by ~, the first hex digits of its SHA-256 and its extension
+// More digits are used until it differs from every other name of the directory
+func exportedNames(names []string) []string {
+	res := slices.Clone(names)
+	taken := make(map[string]bool)
+	for _, n := range names {
+		if len(n) <= FILENAME_MAX_SIZE {
+			taken[n] = true
+		}
+	}
+
+	for i, n := range names {
+		if len(n) <= FILENAME_MAX_SIZE {
+			continue
+		}
+
+		hash := hex.EncodeToString(getHashOfByteSlice([]byte(n)))
+		for nbDigits := SHORT_NAME_HASH_DIGITS; nbDigits < FILENAME_MAX_SIZE; nbDigits++ {
+			res[i] = shortenName(n, hash[:nbDigits])
+			if !taken[res[i]] {
+				break
+			}
+		}
+		taken[res[i]] = true
+	}
+	return res
+}
+
+func shortenName(name string, digits string) string {
+	ext := filepath.Ext(name)
+	if len(ext) > SHORT_NAME_MAX_EXT_SIZE || len(ext) == len(name) || 1+len(digits)+len(ext) > FILENAME_MAX_SIZE {
+		ext = ""
+	}
+
+	// Cut at the start of a UTF-8 character
+	prefix := name[:len(name)-len(ext)]
+	room := FILENAME_MAX_SIZE - 1 - len(digits) - len(ext)
+	for len(prefix) > room || (len(prefix) > 0 && !utf8.RuneStart(name[len(prefix)])) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix + "~" + digits + ext
+}
+
+// Puts each name into the bucket BUCKET_PREFIX+digits+X of base, X being the hex digit after digits in the SHA-256 of the name
+// A name only moves if its bucket is split, and there are at most 16 buckets as there are 16 hex digits
+func splitNames(names []string, indices []int, digits string, base string, res []string) {
+	// The digits of a SHA-256 can't all be the same for different names
+	if len(indices) <= MAX_DIRECTORY_CHILDREN || len(digits) == 2*HASH_SIZE {
+		for _, i := range indices {
+			res[i] = base
+		}
+		return
+	}
+
+	groups := make(map[byte][]int)
+	for _, i := range indices {
+		digit := hex.EncodeToString(getHashOfByteSlice([]byte(names[i])))[len(digits)]
+		groups[digit] = append(groups[digit], i)
+	}
+
+	keys := []byte{}
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, k := range keys {
+		splitNames(names, groups[k], digits+string(k), joinTreePath(base, BUCKET_PREFIX+digits+string(k)), res)
+	}
+}
+
+// Returns the children of dir with the entries put into the buckets given by bucketsOf, and records the buckets in the manifest
+func placeInBuckets(dir *merkleTreeNode, treePath string, entries []*merkleTreeNode, buckets []string, export *exportState) []*merkleTreeNode {
+	res := []*merkleTreeNode{}
+	bucketNodes := make(map[string]*merkleTreeNode)
+
+	var bucketNode func(bucketPath string) *merkleTreeNode
+	bucketNode = func(bucketPath string) *merkleTreeNode {
+		node, found := bucketNodes[bucketPath]
+		if found {
+			return node
+		}
+
+		parent := dir
+		name := bucketPath
+		i := strings.LastIndex(bucketPath, "/")
+		if i >= 0 {
+			parent = bucketNode(bucketPath[:i])
+			name = bucketPath[i+1:]
+		}
+
+		node = newMerkleTreeNode(parent, parent.Path+"/"+name)
+		node.Type = DIRECTORY
+		if parent == dir {
+			res = append(res, node)
+		} else {
+			parent.Children = append(parent.Children, node)
+		}
+		bucketNodes[bucketPath] = node
+		export.Manifest.Buckets = append(export.Manifest.Buckets, joinTreePath(treePath, bucketPath))
+		return node
+	}
+
+	for i, e := range entries {
+		if buckets[i] == "" {
+			res = append(res, e)
+		} else {
+			b := bucketNode(buckets[i])
+			b.Children = append(b.Children, e)
+		}
+	}
+	return res
+}
+
+// Set once a full root was reported by addManifest, so that re-exports don't report it again until the manifest fits
+var manifestNoRoomReported atomic.Bool
+
+// Writes the manifest to MANIFEST_PATH if it changed and adds it at the root of tree, or removes it if there is nothing to undo
+func addManifest(tree *merkleTreeNode, export *exportState) error {
+	if export.Manifest.isEmpty() {
+		os.Remove(MANIFEST_PATH)
+		return nil
+	}
+
+	// The root keeps room for the manifest (see bucketsOf), it is only full if SHARED_FILES_DIR changed while it was walked
+	// Peers then get the tree without the manifest until the next export
+	if len(tree.Children) >= MAX_DIRECTORY_CHILDREN {
+		if !manifestNoRoomReported.Swap(true) {
+			fmt.Fprintf(os.Stderr, "The root of %s has %d entries, no room for %s, our downloaders won't restore the shortened names and buckets\n", SHARED_FILES_DIR, len(tree.Children), MANIFEST_NAME)
+		}
+		return nil
+	}
+	manifestNoRoomReported.Store(false)
+
+	contents, err := json.MarshalIndent(export.Manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Rewritten only if it changed, an unchanged manifest is not hashed again
+	previous, err := os.ReadFile(MANIFEST_PATH)
+	if err != nil || !bytes.Equal(previous, contents) {
+		err = os.WriteFile(MANIFEST_PATH, contents, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	node, err := recursivePathToMerkleTreeWithoutInternalHashes(MANIFEST_PATH, MANIFEST_NAME, tree, export)
+	if err != nil {
+		return err
+	}
+	tree.Children = append(tree.Children, node)
+	return nil
+}
+
+// Downloads the manifest at the root of a peer, an empty manifest if the peer has none or it is invalid
+func getPeerManifest(peerName string, root []byte) (*exportManifest, error) {
+	manifest := &exportManifest{}
+
+	datumType, datum, err := DownloadDatum(peerName, root)
+	if err != nil {
+		return nil, err
+	}
+	if datumType != DIRECTORY {
+		return manifest, nil
+	}
+	hash, found := datum.(datumDirectory).Children[MANIFEST_NAME]
+	if !found {
+		return manifest, nil
+	}
+
+	contents, err := downloadToMemory(peerName, hash)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(contents, manifest)
+	if err != nil {
+		LOGGING_FUNC("Ignoring the invalid manifest of", peerName+":", err)
+		return &exportManifest{}, nil
+	}
+	manifest.hash = hash
+	return manifest, nil
+}
+
+// Downloads the file datum with hash, a big file goes through a temporary file
+func downloadToMemory(peerName string, hash []byte) ([]byte, error) {
+	datumType, datum, err := DownloadDatum(peerName, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	switch datumType {
+	case CHUNK:
+		return datum.(datumChunk).Contents, nil
+	case TREE:
+		f, err := os.CreateTemp("", "psi-")
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+
+		err = writeBigFile(peerName, datum.(datumTree), f.Name())
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(f.Name())
+	default:
+		return nil, fmt.Errorf("expected a file but got a directory")
+	}
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type merkleTreeNode struct {
@@ -29,14 +36,53 @@ type merkleTreeNode struct {
 
 	// -1 if not CHUNK
 	ChunkIndex int
+
+	// Size, modification time and inode of the file when it was hashed, only set on the node of a whole file
+	Size    int64
+	ModTime time.Time
+	Inode   uint64
+
+	// Name in the directory datum of the parent if it is not the base name of Path, see exportedNames
+	Name string
 }
 
+// Protected by a RWMutex
+// Replaced together by exportMerkleTree while requests are in flight, use ourTreeGet
 var ourTree *merkleTreeNode
 
 // Maps a hash as string(h), with h being the hash in []byte to a pointer of the merkleTreeNode that represents it
 var ourTreeMap map[string]*merkleTreeNode
 
+// Maps the path of a file to its node, reused by the next export if the file didn't change
+var ourTreeFiles map[string]*merkleTreeNode
+
+// Maps the path in the tree of a shortened name to the original name
+var ourTreeNames map[string]string
+
+// Problems found by validateSharedFiles at the previous export, each problem is reported once
+var ourTreeProblems map[string]bool
+var ourTreeMutex = &sync.RWMutex{}
+
+func ourTreeGet() (*merkleTreeNode, map[string]*merkleTreeNode) {
+	ourTreeMutex.RLock()
+	defer ourTreeMutex.RUnlock()
+
+	return ourTree, ourTreeMap
+}
+
+// Returns our root, the hash of an empty directory until the first export ends
+func ourRootHash() []byte {
+	tree, _ := ourTreeGet()
+	if tree == nil {
+		return getHashOfByteSlice([]byte{DIRECTORY})
+	}
+	return tree.Hash
+}
+
 func (node *merkleTreeNode) basename() string {
+	if node.Name != "" {
+		return node.Name
+	}
 	return replaceAllRegexBy(node.Path, ".*/", "")
 }
 
@@ -49,8 +95,6 @@ func (bigFile *merkleTreeNode) addChunkLeaves(nbChunkToCreate int, nextChunkInde
 		newChunk := newMerkleTreeNode(bigFile, bigFile.Path)
 		newChunk.Type = CHUNK
 		newChunk.ChunkIndex = nextChunkIndex
-		chunkWithoutType, _ := getChunkContents(newChunk.Path, int64(newChunk.ChunkIndex))
-		newChunk.Hash = getChunkHash(chunkWithoutType)
 
 		bigFile.Children = append(bigFile.Children, newChunk)
 
@@ -118,15 +162,53 @@ func (node *merkleTreeNode) toMap() map[string]*merkleTreeNode {
 	return currentMap
 }
 
+// What an export collects while walking SHARED_FILES_DIR
+type exportState struct {
+	// Nodes of the files of the previous export by path, reused as is if the file has the same size, modification time and inode
+	// The Parent of a reused node is then in the previous tree
+	PreviousFiles map[string]*merkleTreeNode
+	Files         map[string]*merkleTreeNode
+
+	// Hashes of the files saved by a previous run, only used by the first export
+	Cache map[string]hashCacheEntry
+
+	// Nodes of the files to read, hashed by hashFiles once the tree is built
+	ToHash []*merkleTreeNode
+
+	// What peers need to undo the changes made to export SHARED_FILES_DIR
+	Manifest exportManifest
+
+	// Set by validateSharedFiles before walking, the root then keeps room for the manifest
+	NeedsManifest bool
+
+	// Maps the path in the tree of a file or directory whose name was shortened to its path
+	Shortened map[string]string
+}
+
 // First call is supposed to be done on the directory representing the root, its Parent will be nil
 // Computes hashes for all leaf nodes (DIRECTORY or CHUNK)
-func recursivePathToMerkleTreeWithoutInternalHashes(path string, parent *merkleTreeNode) (*merkleTreeNode, error) {
+// treePath is the path of the node in the exported tree, relative to its root
+func recursivePathToMerkleTreeWithoutInternalHashes(path string, treePath string, parent *merkleTreeNode, export *exportState) (*merkleTreeNode, error) {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
 		return nil, err
 	}
 
+	// The last element of treePath is our name in the tree
+	name := treePath[strings.LastIndex(treePath, "/")+1:]
+
+	if !fileInfo.IsDir() {
+		previous, found := export.PreviousFiles[path]
+		if found && previous.isFile(fileInfo) && previous.basename() == name {
+			export.Files[path] = previous
+			return previous, nil
+		}
+	}
+
 	ret := newMerkleTreeNode(parent, path)
+	if parent != nil && name != ret.basename() {
+		ret.Name = name
+	}
 
 	if fileInfo.IsDir() {
 		ret.Type = DIRECTORY
@@ -140,66 +222,117 @@ func recursivePathToMerkleTreeWithoutInternalHashes(path string, parent *merkleT
 			ret.Hash = getHashOfByteSlice([]byte{DIRECTORY})
 		}
 
+		names := []string{}
 		for _, entry := range entries {
-			recursiveCall, err := recursivePathToMerkleTreeWithoutInternalHashes(path+"/"+entry.Name(), ret)
+			names = append(names, entry.Name())
+		}
+		names = exportedNames(names)
+		buckets := bucketsOf(names, parent == nil && export.NeedsManifest)
+
+		for i, entry := range entries {
+			childTreePath := joinTreePath(treePath, joinTreePath(buckets[i], names[i]))
+			if names[i] != entry.Name() {
+				export.Manifest.Names[childTreePath] = entry.Name()
+				export.Shortened[childTreePath] = path + "/" + entry.Name()
+			}
+
+			recursiveCall, err := recursivePathToMerkleTreeWithoutInternalHashes(path+"/"+entry.Name(), childTreePath, ret, export)
 			if err != nil {
 				return nil, err
 			}
 			ret.Children = append(ret.Children, recursiveCall)
 		}
+
+		ret.Children = placeInBuckets(ret, treePath, ret.Children, buckets, export)
 	} else {
 		if fileInfo.Size() <= CHUNK_MAX_SIZE {
 			ret.Type = CHUNK
 			ret.ChunkIndex = 0
-
-			chunkWithoutType, _ := getChunkContents(path, 0)
-			ret.Hash = getChunkHash(chunkWithoutType)
 		} else {
 			ret.Type = TREE
 			fillBigFile(ret)
 		}
+		ret.Size = fileInfo.Size()
+		ret.ModTime = fileInfo.ModTime()
+		ret.Inode = fileInode(fileInfo)
+
+		cached, found := export.Cache[path]
+		if !found || !cached.restore(ret) {
+			export.ToHash = append(export.ToHash, ret)
+		}
+		export.Files[path] = ret
 	}
 
 	return ret, nil
 }
 
 func newMerkleTreeNode(parent *merkleTreeNode, path string) *merkleTreeNode {
-	return &merkleTreeNode{parent, path, []*merkleTreeNode{}, nil, 255, -1}
+	return &merkleTreeNode{parent, path, []*merkleTreeNode{}, nil, 255, -1, 0, time.Time{}, 0, ""}
 }
 
-// root is the root of a big file-only tree
-// Per-level traversal of tree
-func searchNextBigFile(root *merkleTreeNode) *merkleTreeNode {
-	queue := []*merkleTreeNode{root}
+// True if node is the node of a whole file that was hashed when it had the size, modification time and inode of fileInfo
+func (node *merkleTreeNode) isFile(fileInfo os.FileInfo) bool {
+	return node.Size == fileInfo.Size() && node.ModTime.Equal(fileInfo.ModTime()) && node.Inode == fileInode(fileInfo)
+}
 
-	for len(queue) != 0 {
-		nextQueue := []*merkleTreeNode{}
+// Hashes the chunks of the file of node, reading it once from start to end
+func (node *merkleTreeNode) hashFile(progress *hashProgress) error {
+	leaves := []*merkleTreeNode{}
+	for _, n := range node.preOrder() {
+		if n.Type == CHUNK {
+			leaves = append(leaves, n)
+		}
+	}
+	sort.Slice(leaves, func(i, j int) bool { return leaves[i].ChunkIndex < leaves[j].ChunkIndex })
 
-		for _, n := range queue {
-			if len(n.Children) < MAX_TREE_CHILDREN {
-				return n
-			}
+	f, err := os.Open(node.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-			nextQueue = append(nextQueue, n.Children...)
+	reader := bufio.NewReaderSize(f, HASH_READ_BUFFER_SIZE)
+	buf := make([]byte, CHUNK_MAX_SIZE)
+	remaining := node.Size
+	for _, leaf := range leaves {
+		chunkSize := min(remaining, CHUNK_MAX_SIZE)
+		_, err = io.ReadFull(reader, buf[:chunkSize])
+		if err != nil {
+			return fmt.Errorf("%s changed while it was hashed: %w", node.Path, err)
 		}
-
-		queue = nextQueue
+		leaf.Hash = getChunkHash(buf[:chunkSize])
+		remaining -= chunkSize
+		progress.HashedBytes.Add(chunkSize)
 	}
+	return nil
+}
 
-	return nil // Unreachable code because leaves are TREEs
+// Returns node and the nodes under it, each node before its children
+func (node *merkleTreeNode) preOrder() []*merkleTreeNode {
+	res := []*merkleTreeNode{node}
+	for _, child := range node.Children {
+		res = append(res, child.preOrder()...)
+	}
+	return res
 }
 
 // Fills the Children field of node recursively.
 // node is assumed of type TREE and correct (i.e. Type and Path already initialized)
 func fillBigFile(root *merkleTreeNode) {
 	currentChunkCapacity := MAX_TREE_CHILDREN
-	currentBigFile := root // The big file to which we add big file children
+
+	// The TREE nodes in per-level order, big file children are added to the first one that is not full
+	bigFiles := []*merkleTreeNode{root}
+	currentBigFile := 0
 	nbChunk, _ := getNbOfChunks(root.Path)
 	for currentChunkCapacity < nbChunk {
-		currentBigFile = searchNextBigFile(root) // searchNextBigFile needs the root of the big file tree
-		newChild := newMerkleTreeNode(currentBigFile, root.Path)
+		for len(bigFiles[currentBigFile].Children) == MAX_TREE_CHILDREN {
+			currentBigFile++
+		}
+		newChild := newMerkleTreeNode(bigFiles[currentBigFile], root.Path)
 		newChild.Type = TREE
-		currentBigFile.Children = append(currentBigFile.Children, newChild)
+		bigFiles[currentBigFile].Children = append(bigFiles[currentBigFile].Children, newChild)
+		bigFiles = append(bigFiles, newChild)
 
 		currentChunkCapacity += MAX_TREE_CHILDREN - 1
 	}
@@ -269,16 +402,105 @@ func getChunkHash(chunkWithoutType []byte) []byte {
 	return getHashOfByteSlice(chunkWithType)
 }
 
-func exportMerkleTree() error {
-	var err error
-	ourTree, err = recursivePathToMerkleTreeWithoutInternalHashes(SHARED_FILES_DIR, nil)
+// Builds the tree of SHARED_FILES_DIR and replaces ourTree with it
+// Only the files that changed since the previous export are hashed again, the directories above them get new hashes
+// Returns true if our root changed, it is then published
+func exportMerkleTree() (bool, error) {
+	ourTreeMutex.RLock()
+	previousFiles := ourTreeFiles
+	previousNames := ourTreeNames
+	previousProblems := ourTreeProblems
+	ourTreeMutex.RUnlock()
+
+	problems, needsManifest := validateSharedFiles(SHARED_FILES_DIR)
+	reportedProblems := reportSharedFilesProblems(problems, previousProblems)
+
+	export := &exportState{
+		PreviousFiles: previousFiles,
+		Files:         make(map[string]*merkleTreeNode),
+		Manifest:      exportManifest{Names: make(map[string]string)},
+		NeedsManifest: needsManifest,
+		Shortened:     make(map[string]string),
+	}
+	if previousFiles == nil {
+		export.Cache = loadHashCache()
+	}
+	tree, err := recursivePathToMerkleTreeWithoutInternalHashes(SHARED_FILES_DIR, "", nil, export)
 	if err != nil {
-		return err
+		return false, err
+	}
+	err = addManifest(tree, export)
+	if err != nil {
+		return false, err
+	}
+	err = hashFiles(export.ToHash)
+	if err != nil {
+		return false, err
+	}
+	tree.computeHashesRecursively()
+
+	// Each shortened name is reported once
+	treePaths := getKeys(export.Shortened)
+	sort.Strings(treePaths)
+	for _, p := range treePaths {
+		_, found := previousNames[p]
+		if !found {
+			fmt.Fprintf(os.Stderr, "%s is exported as %s, names are limited to %d bytes\n", export.Shortened[p], p, FILENAME_MAX_SIZE)
+		}
+	}
+	treeMap := tree.toMap()
+
+	ourTreeMutex.Lock()
+	changed := ourTree == nil || !bytes.Equal(ourTree.Hash, tree.Hash)
+	ourTree = tree
+	ourTreeMap = treeMap
+	ourTreeFiles = export.Files
+	ourTreeNames = export.Manifest.Names
+	ourTreeProblems = reportedProblems
+	ourTreeMutex.Unlock()
+
+	// Saved again only if files were hashed or removed
+	nbPreviousFiles := len(previousFiles)
+	if previousFiles == nil {
+		nbPreviousFiles = len(export.Cache)
+	}
+	if len(export.ToHash) > 0 || len(export.Files) != nbPreviousFiles {
+		err = saveHashCache(export.Files)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't save the hash cache:", err)
+		}
 	}
-	ourTree.computeHashesRecursively()
 
-	ourTreeMap = ourTree.toMap()
-	return nil
+	if !changed {
+		return false, nil
+	}
+
+	// As the main peer we are the REST server that peers get our root from
+	if restServerOn {
+		restServerMutex.Lock()
+		restServerRoots[OUR_PEER_NAME] = tree.Hash
+		restServerMutex.Unlock()
+	} else {
+		requestRestPublish()
+	}
+	return true, nil
+}
+
+// Prints the problems of validateSharedFiles that are not in previousProblems and returns them all as a set
+func reportSharedFilesProblems(problems []string, previousProblems map[string]bool) map[string]bool {
+	res := make(map[string]bool)
+	nbNew := 0
+	for _, p := range problems {
+		res[p] = true
+		if !previousProblems[p] {
+			fmt.Fprintln(os.Stderr, p)
+			nbNew++
+		}
+	}
+	if nbNew > 0 && !SPLIT_LARGE_DIRECTORIES {
+		fmt.Fprintln(os.Stderr, "Peers will reject the directories with too many entries, --split-dirs splits them into buckets that our downloader reassembles")
+	}
+	return res
 }
 
 func (node *merkleTreeNode) toDatum(id uint32) (udpMsg, error) {
@@ -290,6 +512,10 @@ func (node *merkleTreeNode) toDatum(id uint32) (udpMsg, error) {
 		if err != nil {
 			return udpMsg{}, err
 		}
+		// The file changed since it was hashed, the next export will have its new hash
+		if !bytes.Equal(getChunkHash(chunk), node.Hash) {
+			return udpMsg{}, fmt.Errorf("%s changed since it was hashed", node.Path)
+		}
 		body = append(body, chunk...)
 	case DIRECTORY:
 		for _, child := range node.Children {
@@ -3,13 +3,32 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"strings"
 )
 
 // TODO Transform some of these functions into methods
 
+// Errors of the parsers, they are wrapped with details so use errors.Is
+// Every parser checks lengths before indexing so that a hostile packet can't make it panic
+var (
+	errMsgTooShort       = errors.New("message too short")
+	errMsgSize           = errors.New("invalid message size")
+	errUnknownDatumType  = errors.New("invalid datum type")
+	errDatumTooShort     = errors.New("datum too short")
+	errDatumSize         = errors.New("invalid datum size")
+	errDatumCorrupted    = errors.New("corrupted datum")
+	errChildrenCount     = errors.New("invalid number of children")
+	errInvalidFilename   = errors.New("invalid filename")
+	errDuplicateFilename = errors.New("duplicate filename")
+	errHelloTooShort     = errors.New("Hello[Reply] is too short")
+	errBodySize          = errors.New("invalid body size")
+	errAddrSize          = errors.New("invalid address size")
+)
+
 // It is assumed that len(Body) == Length
 // Does not support cryptographic footer
 type udpMsg struct {
@@ -74,33 +93,33 @@ func udpMsgToByteSlice(toCast udpMsg) []byte {
 //   - bytesRead: the number of bytes that was received for this message
 //   - Returns: a valid udpMsg and nil or an empty udpMsg and err
 func byteSliceToUdpMsg(toCast []byte, bytesRead int) (udpMsg, error) {
-	if len(toCast) < ID_SIZE+TYPE_SIZE+LENGTH_SIZE {
-		return udpMsg{}, fmt.Errorf("Message too small")
+	if bytesRead > len(toCast) || bytesRead < 0 {
+		return udpMsg{}, fmt.Errorf("%w: %d bytes read but the buffer has %d bytes", errMsgSize, bytesRead, len(toCast))
+	}
+	if bytesRead < ID_SIZE+TYPE_SIZE+LENGTH_SIZE {
+		return udpMsg{}, fmt.Errorf("%w: %d bytes but the header has %d bytes", errMsgTooShort, bytesRead, ID_SIZE+TYPE_SIZE+LENGTH_SIZE)
 	}
 
 	var m udpMsg
 	m.Id = binary.BigEndian.Uint32(toCast[:ID_SIZE])
+	// Unknown types are kept so that we can reply with an ErrorReply
 	m.Type = toCast[ID_SIZE]
 
-	_, err := byteToMsgTypeAsStr(m.Type)
-	if err != nil {
-		return udpMsg{}, err
-	}
-
 	m.Length = binary.BigEndian.Uint16(toCast[ID_SIZE+1 : ID_SIZE+1+LENGTH_SIZE])
 
-	expectedSizeWithoutSig := ID_SIZE + TYPE_SIZE + LENGTH_SIZE + m.Length
-	if bytesRead < int(expectedSizeWithoutSig) {
-		return udpMsg{}, fmt.Errorf("UDP message too small: stated length %d but received %d bytes", m.Length, bytesRead)
+	// In int, the sum overflows in uint16
+	bodyEnd := BODY_START_INDEX + int(m.Length)
+	if bytesRead < bodyEnd {
+		return udpMsg{}, fmt.Errorf("%w: stated length %d but received %d bytes", errMsgTooShort, m.Length, bytesRead)
 	}
 
-	m.Body = append([]byte{}, toCast[BODY_START_INDEX:BODY_START_INDEX+m.Length]...)
+	m.Body = append([]byte{}, toCast[BODY_START_INDEX:bodyEnd]...)
 
-	if bytesRead == int(m.Length)+ID_SIZE+TYPE_SIZE+LENGTH_SIZE+SIGNATURE_SIZE {
+	if bytesRead == bodyEnd+SIGNATURE_SIZE {
 		LOGGING_FUNC("MSG CONTAINS SIGNATURE")
-		m.Signature = append(m.Signature, toCast[ID_SIZE+TYPE_SIZE+LENGTH_SIZE+m.Length:ID_SIZE+TYPE_SIZE+LENGTH_SIZE+m.Length+SIGNATURE_SIZE]...)
-	} else if bytesRead != int(m.Length)+ID_SIZE+TYPE_SIZE+LENGTH_SIZE {
-		return udpMsg{}, fmt.Errorf("Invalid message size")
+		m.Signature = append(m.Signature, toCast[bodyEnd:bodyEnd+SIGNATURE_SIZE]...)
+	} else if bytesRead != bodyEnd {
+		return udpMsg{}, fmt.Errorf("%w: stated length %d, %d bytes received but %d or %d expected", errMsgSize, m.Length, bytesRead, bodyEnd, bodyEnd+SIGNATURE_SIZE)
 	}
 
 	return m, nil
@@ -141,7 +160,7 @@ func udpMsgToString(msg udpMsg) string {
 	typeAsString, _ := byteToMsgTypeAsStr(msg.Type)
 
 	childrenNames := ""
-	if msg.Type == DATUM {
+	if msg.Type == DATUM && len(msg.Body) > DATUM_TYPE_INDEX {
 		datumType, _ := byteToDatumTypeAsStr(msg.Body[DATUM_TYPE_INDEX])
 		typeAsString += " " + datumType
 		if msg.Body[DATUM_TYPE_INDEX] == DIRECTORY {
@@ -149,7 +168,7 @@ func udpMsgToString(msg udpMsg) string {
 			nbEntry := (len(msg.Body) - int(DATUM_CONTENTS_INDEX)) / int(DIRECTORY_ENTRY_SIZE)
 			startOffset := DATUM_CONTENTS_INDEX
 			for i := 0; i < nbEntry; i++ {
-				name := zeroPaddedByteSliceToString(msg.Body[startOffset+i*DIRECTORY_ENTRY_SIZE : startOffset+i*DIRECTORY_ENTRY_SIZE+FILENAME_MAX_SIZE])
+				name, _ := zeroPaddedByteSliceToString(msg.Body[startOffset+i*DIRECTORY_ENTRY_SIZE : startOffset+i*DIRECTORY_ENTRY_SIZE+FILENAME_MAX_SIZE])
 				childrenNames += name + "\n\t"
 			}
 		}
@@ -185,22 +204,42 @@ func udpMsgToStringShort(msg udpMsg) string {
 // - Returns: - a map containing the names and the hashes of the directory datum message
 //   - nil in case of error
 func parseDirectory(body []byte) (map[string][]byte, error) {
+	if len(body) < DATUM_CONTENTS_INDEX {
+		return nil, fmt.Errorf("%w: %d bytes", errDatumTooShort, len(body))
+	}
 	if body[DATUM_TYPE_INDEX] != DIRECTORY {
 		return nil, fmt.Errorf("not a directory")
 	}
 
 	res := make(map[string][]byte)
 
-	nbEntry := (len(body) - int(DATUM_CONTENTS_INDEX)) / int(DIRECTORY_ENTRY_SIZE)
+	contentsSize := len(body) - DATUM_CONTENTS_INDEX
+	if contentsSize%DIRECTORY_ENTRY_SIZE != 0 {
+		return nil, fmt.Errorf("%w: directory contents of %d bytes is not a multiple of %d", errDatumSize, contentsSize, DIRECTORY_ENTRY_SIZE)
+	}
 
-	if nbEntry < 0 || nbEntry > MAX_DIRECTORY_CHILDREN {
-		return nil, fmt.Errorf("wrong number %d of children for directory", nbEntry)
+	nbEntry := contentsSize / DIRECTORY_ENTRY_SIZE
+	if nbEntry > MAX_DIRECTORY_CHILDREN {
+		return nil, fmt.Errorf("%w: %d children for directory", errChildrenCount, nbEntry)
 	}
 
 	for i := 0; i < int(nbEntry); i++ {
 		keyStart := int(DATUM_CONTENTS_INDEX) + i*int(DIRECTORY_ENTRY_SIZE)
 		valueStart := keyStart + FILENAME_MAX_SIZE
-		filename := zeroPaddedByteSliceToString(body[keyStart:valueStart])
+		filename, err := zeroPaddedByteSliceToString(body[keyStart:valueStart])
+		if err != nil {
+			return nil, err
+		}
+
+		// The names become paths when downloading
+		if filename == "." || filename == ".." || strings.Contains(filename, "/") {
+			return nil, fmt.Errorf("%w: %q", errInvalidFilename, filename)
+		}
+
+		_, found := res[filename]
+		if found {
+			return nil, fmt.Errorf("%w: %q", errDuplicateFilename, filename)
+		}
 
 		res[filename] = body[valueStart : valueStart+HASH_SIZE]
 	}
@@ -213,16 +252,23 @@ func parseDirectory(body []byte) (map[string][]byte, error) {
 // - Returns: - a slice of slices of byte containing the hashes of children
 //   - nil in case of error
 func parseTree(body []byte) ([][]byte, error) {
+	if len(body) < DATUM_CONTENTS_INDEX {
+		return nil, fmt.Errorf("%w: %d bytes", errDatumTooShort, len(body))
+	}
 	if body[DATUM_TYPE_INDEX] != TREE {
 		return nil, fmt.Errorf("not a tree/big file")
 	}
 
 	res := [][]byte{}
 
-	nbEntry := (len(body) - int(DATUM_CONTENTS_INDEX)) / int(HASH_SIZE)
+	contentsSize := len(body) - DATUM_CONTENTS_INDEX
+	if contentsSize%HASH_SIZE != 0 {
+		return nil, fmt.Errorf("%w: tree/big file contents of %d bytes is not a multiple of %d", errDatumSize, contentsSize, HASH_SIZE)
+	}
 
+	nbEntry := contentsSize / HASH_SIZE
 	if nbEntry < MIN_TREE_CHILDREN || nbEntry > MAX_TREE_CHILDREN {
-		return nil, fmt.Errorf("invalid number %d of children for tree/big file", nbEntry)
+		return nil, fmt.Errorf("%w: %d children for tree/big file", errChildrenCount, nbEntry)
 	}
 
 	for i := 0; i < int(nbEntry); i++ {
@@ -241,11 +287,18 @@ func parseTree(body []byte) ([][]byte, error) {
 //
 // We assume that the udpMsg that is parsed will not be modified
 func parseDatum(body []byte) (byte, interface{}, error) {
+	if len(body) < DATUM_CONTENTS_INDEX {
+		return 0, nil, fmt.Errorf("%w: %d bytes but at least %d expected", errDatumTooShort, len(body), DATUM_CONTENTS_INDEX)
+	}
+
 	datumType := body[DATUM_TYPE_INDEX]
 	statedHash := body[:HASH_SIZE]
 
 	switch datumType {
 	case CHUNK:
+		if len(body)-DATUM_CONTENTS_INDEX > CHUNK_MAX_SIZE {
+			return 0, nil, fmt.Errorf("%w: chunk of %d bytes", errDatumSize, len(body)-DATUM_CONTENTS_INDEX)
+		}
 		return datumType, datumChunk{statedHash, datumType, body[DATUM_CONTENTS_INDEX:]}, nil
 	case TREE:
 		hashList, err := parseTree(body)
@@ -264,7 +317,7 @@ func parseDatum(body []byte) (byte, interface{}, error) {
 
 		return datumType, datumDirectory{statedHash, datumType, filenameHashMap}, nil
 	default:
-		return 0, nil, fmt.Errorf("invalid datum type")
+		return 0, nil, fmt.Errorf("%w %d", errUnknownDatumType, datumType)
 	}
 }
 
@@ -282,38 +335,44 @@ func parseHello(body []byte) (hello, error) {
 	length := len(body)
 
 	if length < HELLO_EXTENSIONS_SIZE+1 {
-		return hello{}, fmt.Errorf("Hello[Reply] is too short")
+		return hello{}, fmt.Errorf("%w: %d bytes but at least %d expected", errHelloTooShort, length, HELLO_EXTENSIONS_SIZE+1)
 	}
 
 	extensions := binary.BigEndian.Uint32(body[:HELLO_EXTENSIONS_SIZE])
 	peerName := string(body[HELLO_EXTENSIONS_SIZE:])
 
-	return hello{extensions, peerName}, nil
+	return hello{Extensions: extensions, PeerName: peerName}, nil
 }
 
 // Creates a valid hello message containing our peer name.
+// - peerName: our peer name, the name of the node that sends it
 // - Returns: a valid hello udpMsg
-func createHello() udpMsg {
-	var helloMsg udpMsg
-	extensions := make([]byte, HELLO_EXTENSIONS_SIZE)
-	nameAsBytes := []byte(OUR_PEER_NAME)
-	var res = append(extensions, nameAsBytes...)
-	helloMsg = createMsg(HELLO, res)
-	return helloMsg
+func createHello(peerName string) udpMsg {
+	ourHelloBody := hello{Extensions: ourExtensions(), PeerName: peerName}
+	return createMsg(HELLO, helloToByteSlice(ourHelloBody))
 }
 
-func createComplexHello(msgId uint32, msgType byte) (udpMsg, error) {
+func createComplexHello(peerName string, msgId uint32, msgType byte) (udpMsg, error) {
 	if msgType != HELLO && msgType != HELLO_REPLY {
 		msgTypeStr, _ := byteToMsgTypeAsStr(msgType)
 		return udpMsg{}, fmt.Errorf("invalid message type %s (%d) when creating Hello/HelloReply", msgTypeStr, msgType)
 	}
 
-	ourHelloBody := hello{OUR_EXTENSIONS, OUR_PEER_NAME}
+	ourHelloBody := hello{Extensions: ourExtensions(), PeerName: peerName}
 
 	ourHello := createMsgWithId(msgId, msgType, helloToByteSlice(ourHelloBody))
 	return ourHello, nil
 }
 
+// Creates an ErrorReply to the request msgId, reason is truncated if it doesn't fit in a message
+func createErrorReply(msgId uint32, reason string) udpMsg {
+	body := []byte(reason)
+	if len(body) > BODY_MAX_SIZE {
+		body = body[:BODY_MAX_SIZE]
+	}
+	return createMsgWithId(msgId, ERROR_REPLY, body)
+}
+
 // TODO Use htons/htonl instead of BigEndian
 
 // We never send NatTraversal, it is the main server who does it
@@ -332,12 +391,16 @@ func checkMsgTypePair(sent uint8, received uint8) bool {
 // - Returns: error if data is not valid
 // TODO Check that filenames in directory are valid UTF-8
 func checkDatumIntegrity(body []byte) error {
+	if len(body) < DATUM_CONTENTS_INDEX {
+		return fmt.Errorf("%w: %d bytes but at least %d expected", errDatumTooShort, len(body), DATUM_CONTENTS_INDEX)
+	}
+
 	statedHash := body[:HASH_SIZE]
 
 	computedHash := getHashOfByteSlice(body[DATUM_TYPE_INDEX:])
 
 	if !bytes.Equal(statedHash, computedHash) {
-		return fmt.Errorf("corrupted datum")
+		return errDatumCorrupted
 	}
 
 	_, _, err := parseDatum(body)
@@ -354,7 +417,20 @@ func checkMsgIntegrity(msg udpMsg) error {
 		return checkDatumIntegrity(msg.Body)
 	case NAT_TRAVERSAL_REQUEST, NAT_TRAVERSAL:
 		if msg.Length != UDP_V4_SOCKET_SIZE && msg.Length != UDP_V6_SOCKET_SIZE {
-			return fmt.Errorf("invalid NatTraversal[Request] size")
+			return fmt.Errorf("%w: NatTraversal[Request] of %d bytes, expected %d or %d", errAddrSize, msg.Length, UDP_V4_SOCKET_SIZE, UDP_V6_SOCKET_SIZE)
+		}
+	case ROOT_REPLY, GET_DATUM, NO_DATUM:
+		if msg.Length != HASH_SIZE {
+			t, _ := byteToMsgTypeAsStr(msg.Type)
+			return fmt.Errorf("%w: %s of %d bytes, expected a hash of %d bytes", errBodySize, t, msg.Length, HASH_SIZE)
+		}
+	case SEALED, SEALED_REPLY:
+		if int(msg.Length) < SEALED_OVERHEAD {
+			return fmt.Errorf("%w: Sealed[Reply] of %d bytes, at least %d expected", errBodySize, msg.Length, SEALED_OVERHEAD)
+		}
+	case PUBLIC_KEY_REPLY:
+		if msg.Length != 0 && msg.Length != KEY_SIZE {
+			return fmt.Errorf("%w: PublicKeyReply of %d bytes, expected 0 or %d", errBodySize, msg.Length, KEY_SIZE)
 		}
 	}
 
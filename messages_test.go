@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Returns a datum whose stated hash is the hash of its type and contents
+func testDatum(datumType byte, contents []byte) []byte {
+	body := append([]byte{datumType}, contents...)
+	return append(getHashOfByteSlice(body), body...)
+}
+
+// Returns the contents of a directory datum with an entry per name
+func testDirectoryContents(names ...string) []byte {
+	res := []byte{}
+	for _, n := range names {
+		res = append(res, stringToZeroPaddedByteSlice(n)...)
+		res = append(res, getHashOfByteSlice([]byte(n))...)
+	}
+	return res
+}
+
+type parserSeed struct {
+	Name string
+	Data []byte
+	Err  error // nil if the data is valid
+}
+
+// Seed corpus of FuzzByteSliceToUdpMsg, with the error of each seed
+var udpMsgSeeds = []parserSeed{
+	{"hello", udpMsgToByteSlice(udpMsg{1, HELLO, 5, []byte{0, 0, 0, 0, 'a'}, nil}), nil},
+	{"signed", udpMsgToByteSlice(udpMsg{1, ROOT, 0, []byte{}, make([]byte, SIGNATURE_SIZE)}), nil},
+	{"short header", []byte{0, 0, 0}, errMsgTooShort},
+	{"short body", []byte{0, 0, 0, 1, ROOT, 0, 10, 1, 2}, errMsgTooShort},
+	{"trailing bytes", []byte{0, 0, 0, 1, ROOT, 0, 0, 1, 2, 3}, errMsgSize},
+}
+
+// Seed corpus of FuzzParseDatum
+var datumSeeds = []parserSeed{
+	{"chunk", testDatum(CHUNK, []byte("hello")), nil},
+	{"tree", testDatum(TREE, make([]byte, 2*HASH_SIZE)), nil},
+	{"directory", testDatum(DIRECTORY, testDirectoryContents("a", "b")), nil},
+	{"empty directory", testDatum(DIRECTORY, nil), nil},
+	{"short", make([]byte, HASH_SIZE), errDatumTooShort},
+	{"unknown type", testDatum(3, nil), errUnknownDatumType},
+	{"big chunk", testDatum(CHUNK, make([]byte, CHUNK_MAX_SIZE+1)), errDatumSize},
+	{"partial hash", testDatum(TREE, make([]byte, 2*HASH_SIZE+1)), errDatumSize},
+	{"single child", testDatum(TREE, make([]byte, HASH_SIZE)), errChildrenCount},
+	{"too many children", testDatum(TREE, make([]byte, (MAX_TREE_CHILDREN+1)*HASH_SIZE)), errChildrenCount},
+	{"partial entry", testDatum(DIRECTORY, make([]byte, DIRECTORY_ENTRY_SIZE-1)), errDatumSize},
+	{"too many entries", testDatum(DIRECTORY, testDirectoryContents(strings.Split("abcdefghijklmnopq", "")...)), errChildrenCount},
+	{"empty name", testDatum(DIRECTORY, make([]byte, DIRECTORY_ENTRY_SIZE)), errInvalidFilename},
+	{"dot dot", testDatum(DIRECTORY, testDirectoryContents("..")), errInvalidFilename},
+	{"slash", testDatum(DIRECTORY, testDirectoryContents("a/b")), errInvalidFilename},
+	{"duplicate", testDatum(DIRECTORY, testDirectoryContents("a", "a")), errDuplicateFilename},
+	{"corrupted", append(make([]byte, HASH_SIZE), CHUNK), errDatumCorrupted},
+}
+
+// Seed corpus of FuzzParseHello
+var helloSeeds = []parserSeed{
+	{"hello", []byte{0, 0, 0, 1, 'a'}, nil},
+	{"no name", []byte{0, 0, 0, 1}, errHelloTooShort},
+}
+
+// Seed corpus of FuzzCheckMsgIntegrity, the first byte is the message type
+var msgIntegritySeeds = []parserSeed{
+	{"root reply", append([]byte{ROOT_REPLY}, make([]byte, HASH_SIZE)...), nil},
+	{"nat traversal", []byte{NAT_TRAVERSAL, 127, 0, 0, 1, 0x21, 0x02}, nil},
+	{"short root reply", []byte{ROOT_REPLY, 1, 2, 3}, errBodySize},
+	{"short sealed", []byte{SEALED, 1}, errBodySize},
+	{"bad public key", []byte{PUBLIC_KEY_REPLY, 1}, errBodySize},
+	{"bad address", []byte{NAT_TRAVERSAL, 1, 2, 3, 4, 5}, errAddrSize},
+	{"bad hello", []byte{HELLO, 0}, errHelloTooShort},
+	{"bad datum", []byte{DATUM, 0}, errDatumTooShort},
+}
+
+func checkMsgIntegrityOfSeed(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	body := data[1:]
+	return checkMsgIntegrity(udpMsg{Type: data[0], Length: uint16(len(body)), Body: body})
+}
+
+func parseDatumSeed(data []byte) error {
+	return checkDatumIntegrity(data)
+}
+
+func parseHelloSeed(data []byte) error {
+	_, err := parseHello(data)
+	return err
+}
+
+func parseUdpMsgSeed(data []byte) error {
+	_, err := byteSliceToUdpMsg(data, len(data))
+	return err
+}
+
+// Every typed error of the parsers has a seed that returns it
+func TestParserErrors(t *testing.T) {
+	targets := []struct {
+		Seeds []parserSeed
+		Parse func([]byte) error
+	}{
+		{udpMsgSeeds, parseUdpMsgSeed},
+		{datumSeeds, parseDatumSeed},
+		{helloSeeds, parseHelloSeed},
+		{msgIntegritySeeds, checkMsgIntegrityOfSeed},
+	}
+
+	covered := make(map[error]bool)
+	for _, target := range targets {
+		for _, s := range target.Seeds {
+			err := target.Parse(s.Data)
+			if s.Err == nil && err != nil {
+				t.Errorf("%s: unexpected error %v", s.Name, err)
+			} else if s.Err != nil && !errors.Is(err, s.Err) {
+				t.Errorf("%s: got error %v, expected %v", s.Name, err, s.Err)
+			}
+			covered[s.Err] = true
+		}
+	}
+
+	for _, e := range []error{errMsgTooShort, errMsgSize, errUnknownDatumType, errDatumTooShort, errDatumSize, errDatumCorrupted,
+		errChildrenCount, errInvalidFilename, errDuplicateFilename, errHelloTooShort, errBodySize, errAddrSize} {
+		if !covered[e] {
+			t.Errorf("no seed for %v", e)
+		}
+	}
+}
+
+func FuzzByteSliceToUdpMsg(f *testing.F) {
+	for _, s := range udpMsgSeeds {
+		f.Add(s.Data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := byteSliceToUdpMsg(data, len(data))
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(udpMsgToByteSlice(m), data) {
+			t.Fatalf("%x parsed as %+v which serializes differently", data, m)
+		}
+		checkMsgIntegrity(m)
+	})
+}
+
+func FuzzParseDatum(f *testing.F) {
+	for _, s := range datumSeeds {
+		f.Add(s.Data)
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		checkDatumIntegrity(body)
+
+		datumType, datum, err := parseDatum(body)
+		if err != nil {
+			return
+		}
+		switch datumType {
+		case TREE:
+			n := len(datum.(datumTree).ChildrenHashes)
+			if n < MIN_TREE_CHILDREN || n > MAX_TREE_CHILDREN {
+				t.Fatalf("tree with %d children accepted", n)
+			}
+		case DIRECTORY:
+			children := datum.(datumDirectory).Children
+			if len(children) > MAX_DIRECTORY_CHILDREN {
+				t.Fatalf("directory with %d children accepted", len(children))
+			}
+			for name, hash := range children {
+				if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") || len(hash) != HASH_SIZE {
+					t.Fatalf("invalid entry %q accepted", name)
+				}
+			}
+		}
+	})
+}
+
+func FuzzParseHello(f *testing.F) {
+	for _, s := range helloSeeds {
+		f.Add(s.Data)
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		h, err := parseHello(body)
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(helloToByteSlice(h), body) {
+			t.Fatalf("%x parsed as %+v which serializes differently", body, h)
+		}
+	})
+}
+
+func FuzzCheckMsgIntegrity(f *testing.F) {
+	for _, s := range msgIntegritySeeds {
+		f.Add(s.Data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		err := checkMsgIntegrityOfSeed(data)
+		if err == nil && len(data) > 0 && (data[0] == NAT_TRAVERSAL || data[0] == NAT_TRAVERSAL_REQUEST) {
+			_, err = byteSliceToUDPAddr(data[1:])
+			if err != nil {
+				t.Fatalf("address %x accepted by checkMsgIntegrity but not parsed: %v", data[1:], err)
+			}
+		}
+	})
+}
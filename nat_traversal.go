@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A NAT traversal in progress towards an address, other traversals to the same address wait for it
+type natTraversalState struct {
+	StartedByUs bool
+	StartTime   time.Time
+	done        chan struct{} // Closed when the traversal is over, err is then set
+	err         error
+}
+
+// NAT types, see detectNatType
+const (
+	NAT_TYPE_UNKNOWN   int32 = 0
+	NAT_TYPE_NONE      int32 = 1 // The main peer sees one of our interface addresses
+	NAT_TYPE_CONE      int32 = 2 // Same public port whatever the destination, hole punching works
+	NAT_TYPE_SYMMETRIC int32 = 3 // A public port per destination, hole punching only works if the other side has no NAT or a cone NAT
+)
+
+// Protected by a Mutex
+// Our addresses as seen by the main peer, updated by keepAliveMainPeer
+// Used to find the peers behind our NAT and to detect our NAT type
+var ourObservedAddrs []*net.UDPAddr
+var ourObservedAddrsMutex *sync.Mutex
+
+func ourObservedAddrsGet() []*net.UDPAddr {
+	ourObservedAddrsMutex.Lock()
+	defer ourObservedAddrsMutex.Unlock()
+
+	return ourObservedAddrs
+}
+
+// Fetches our addresses from the REST server and classifies our NAT again
+// nbMainPeerAddrs is the number of IPv4 addresses of the main peer that just replied to our Hellos
+func (n *udpNode) updateOurObservedAddrs(nbMainPeerAddrs int) {
+	observedAddresses, err := restGetAddressesOfPeer(OUR_PEER_NAME, false)
+	if err != nil {
+		LOGGING_FUNC("Couldn't get our addresses from the REST server:", err)
+		return
+	}
+
+	ourObservedAddrsMutex.Lock()
+	ourObservedAddrs = observedAddresses
+	ourObservedAddrsMutex.Unlock()
+
+	n.natType.Store(detectNatType(observedAddresses, nbMainPeerAddrs))
+}
+
+func natTypeToString(natType int32) string {
+	switch natType {
+	case NAT_TYPE_NONE:
+		return "no NAT"
+	case NAT_TYPE_CONE:
+		return "cone NAT"
+	case NAT_TYPE_SYMMETRIC:
+		return "symmetric NAT"
+	default:
+		return "unknown"
+	}
+}
+
+// Classifies our IPv4 NAT from observedAddresses, the addresses the REST server reports for us
+// They are the addresses from which the main peer received our Hellos, sent from the same port to its nbMainPeerAddrs IPv4 addresses
+//   - one of them is an address of our interfaces: no NAT
+//   - the same public IP is seen with different ports: the NAT allocates a port per destination, it is symmetric
+//   - several main peer addresses saw a single public IP and port: cone
+//
+// Otherwise, e.g. if the main peer has a single IPv4 address, we can't tell
+func detectNatType(observedAddresses []*net.UDPAddr, nbMainPeerAddrs int) int32 {
+	interfaceAddresses, _ := net.InterfaceAddrs()
+	isInterfaceIP := func(ip net.IP) bool {
+		for _, a := range interfaceAddresses {
+			ipNet, ok := a.(*net.IPNet)
+			if ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	portsByIP := make(map[string][]int)
+	for _, a := range observedAddresses {
+		if a.IP.To4() == nil {
+			continue
+		}
+		if isInterfaceIP(a.IP) {
+			return NAT_TYPE_NONE
+		}
+		portsByIP[a.IP.String()] = append(portsByIP[a.IP.String()], a.Port)
+	}
+
+	for _, ports := range portsByIP {
+		for _, p := range ports {
+			if p != ports[0] {
+				return NAT_TYPE_SYMMETRIC
+			}
+		}
+	}
+
+	if len(portsByIP) == 1 && nbMainPeerAddrs > 1 {
+		return NAT_TYPE_CONE
+	}
+	return NAT_TYPE_UNKNOWN
+}
+
+// Runs a NAT traversal towards addr, or waits for the one in progress towards addr
+// Returns nil if addr replied to our Hello
+func (n *udpNode) natTraversal(addr *net.UDPAddr) error {
+	state, isNew := n.natTraversalsGetOrCreate(addr, true)
+	if !isNew {
+		LOGGING_FUNC("NAT traversal with", addr.String(), "already in progress, waiting for it")
+		<-state.done
+		return state.err
+	}
+
+	state.err = n.runNatTraversal(addr, true)
+	n.natTraversalsFinish(addr, state)
+	return state.err
+}
+
+// Called when the main peer tells us that addr wants to reach us, does nothing if a traversal towards addr is in progress
+func (n *udpNode) natTraversalStartedByPeer(addr *net.UDPAddr) {
+	state, isNew := n.natTraversalsGetOrCreate(addr, false)
+	if !isNew {
+		return
+	}
+
+	go func() {
+		state.err = n.runNatTraversal(addr, false)
+		n.natTraversalsFinish(addr, state)
+	}()
+}
+
+func (n *udpNode) natTraversalsGetOrCreate(addr *net.UDPAddr, startedByUs bool) (*natTraversalState, bool) {
+	n.natTraversalsMutex.Lock()
+	defer n.natTraversalsMutex.Unlock()
+
+	state, found := n.natTraversals[addr.String()]
+	if found {
+		return state, false
+	}
+
+	state = &natTraversalState{StartedByUs: startedByUs, StartTime: time.Now(), done: make(chan struct{})}
+	n.natTraversals[addr.String()] = state
+	return state, true
+}
+
+func (n *udpNode) natTraversalsFinish(addr *net.UDPAddr, state *natTraversalState) {
+	n.natTraversalsMutex.Lock()
+	delete(n.natTraversals, addr.String())
+	n.natTraversalsMutex.Unlock()
+
+	close(state.done)
+}
+
+// Punches a hole towards addr: at each attempt we send the same Hello to addr, and if we started the traversal a NatTraversalRequest to every address of the main peer
+// The other side sends Hellos to us when the main peer forwards our request, so both NATs open a mapping at about the same time
+// The wait between attempts doubles from NAT_TRAVERSAL_INITIAL_WAIT to NAT_TRAVERSAL_MAX_WAIT
+func (n *udpNode) runNatTraversal(addr *net.UDPAddr, startedByUs bool) error {
+	LOGGING_FUNC("Starting NAT traversal with", addr.String(), "started by us:", startedByUs)
+
+	// The main peer relays the address from which it received the request, so it must be of the family of addr
+	mainPeerAddresses := []*net.UDPAddr{}
+	if startedByUs {
+		addresses, _ := n.peersGet(SERVER_PEER_NAME)
+		for _, a := range addresses {
+			if n.udpAddrIsReachable(a) && (a.IP.To4() != nil) == (addr.IP.To4() != nil) {
+				mainPeerAddresses = append(mainPeerAddresses, a)
+			}
+		}
+		if len(mainPeerAddresses) == 0 {
+			return fmt.Errorf("no connection with main peer of the family of %s found during our NAT traversal", addr.String())
+		}
+	}
+
+	nbAttempts := NAT_TRAVERSAL_RETRIES
+	if addr.IP.To4() != nil && n.natType.Load() == NAT_TYPE_SYMMETRIC {
+		LOGGING_FUNC("We are behind a symmetric NAT, NAT traversal with", addr.String(), "will probably fail")
+		nbAttempts = NAT_TRAVERSAL_SYMMETRIC_RETRIES
+	}
+
+	natTraversalRequest := createNatTraversalRequestMsg(addr)
+	hello, replyChan := n.pendingRequestsRegister(addr, createHello(n.Name))
+	defer n.pendingRequestsUnregister(addr, hello.Id)
+
+	wait := NAT_TRAVERSAL_INITIAL_WAIT
+	for i := 0; i < nbAttempts; i++ {
+		for _, a := range mainPeerAddresses {
+			n.simpleSendMsgToAddr(a, natTraversalRequest)
+		}
+
+		err := n.simpleSendMsgToAddr(addr, hello)
+		if err != nil {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-replyChan:
+			timer.Stop()
+			LOGGING_FUNC("Hole punched to", addr.String(), "after", i+1, "attempts")
+			// The reply to the probe is not checked, a full exchange checks it now that the path is open
+			_, err = n.sendToAddrAndReceiveMsgWithReemissions(addr, createHello(n.Name))
+			return err
+		case <-timer.C:
+		}
+
+		wait = min(2*wait, NAT_TRAVERSAL_MAX_WAIT)
+	}
+
+	return fmt.Errorf("NAT traversal with %s failed after %d attempts", addr.String(), nbAttempts)
+}
+
+func (n *udpNode) printNatState() {
+	fmt.Println("Our IPv4 NAT:", natTypeToString(n.natType.Load()))
+
+	for _, a := range ourObservedAddrsGet() {
+		fmt.Println("The main peer saw us at", a.String())
+	}
+
+	n.natTraversalsMutex.Lock()
+	defer n.natTraversalsMutex.Unlock()
+
+	addresses := make([]string, 0, len(n.natTraversals))
+	for a := range n.natTraversals {
+		addresses = append(addresses, a)
+	}
+	sort.Strings(addresses)
+
+	for _, a := range addresses {
+		state := n.natTraversals[a]
+		startedBy := "them"
+		if state.StartedByUs {
+			startedBy = "us"
+		}
+		fmt.Printf("NAT traversal with %s started by %s %s ago\n", a, startedBy, time.Since(state.StartTime).Round(time.Second))
+	}
+}
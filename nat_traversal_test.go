@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDetectNatType(t *testing.T) {
+	public := func(port int) *net.UDPAddr { return &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: port} }
+	ipv6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4000}
+
+	cases := []struct {
+		Name            string
+		Observed        []*net.UDPAddr
+		NbMainPeerAddrs int
+		Expected        int32
+	}{
+		{"same mapping for two main peer addresses", []*net.UDPAddr{public(4000), ipv6}, 2, NAT_TYPE_CONE},
+		{"a port per main peer address", []*net.UDPAddr{public(4000), public(4001)}, 2, NAT_TYPE_SYMMETRIC},
+		{"single main peer address", []*net.UDPAddr{public(4000)}, 1, NAT_TYPE_UNKNOWN},
+		{"interface address", []*net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: 4000}}, 1, NAT_TYPE_NONE},
+		{"IPv6 only", []*net.UDPAddr{ipv6}, 2, NAT_TYPE_UNKNOWN},
+	}
+	for _, c := range cases {
+		natType := detectNatType(c.Observed, c.NbMainPeerAddrs)
+		if natType != c.Expected {
+			t.Errorf("%s: %s, expected %s", c.Name, natTypeToString(natType), natTypeToString(c.Expected))
+		}
+	}
+}
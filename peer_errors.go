@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An Error or ErrorReply that a peer sent us
+type peerError struct {
+	Time    time.Time
+	Type    byte // ERROR or ERROR_REPLY
+	Addr    *net.UDPAddr
+	Message string
+}
+
+// The errors sent by a peer, or by an address that is not a known peer
+type peerErrorList struct {
+	Errors []peerError // The last MAX_RECORDED_ERRORS_PER_PEER, oldest first
+	IsAddr bool        // Removed PEER_ERRORS_ADDR_TTL after its last error
+}
+
+// Protected by a Mutex
+// Maps a peer name (or an address if the peer is unknown) to the errors it sent us, for at most MAX_RECORDED_ERROR_SOURCES keys
+var peerErrors map[string]*peerErrorList
+var peerErrorsMutex *sync.Mutex
+
+// Limit of the errors printed to stderr and count of the ones that were not printed since the last one that was
+var peerErrorsPrints tokenBucket
+var peerErrorsNotPrinted int
+
+// Returns the name of the peer that has addr in peers, or addr as a string if there is none
+func (n *udpNode) peerNameOrAddr(addr *net.UDPAddr) string {
+	peerName := n.peersGetKeyFromVal(addr)
+	if peerName == "" {
+		return addr.String()
+	}
+	return peerName
+}
+
+func (n *udpNode) peerErrorsRecord(addr *net.UDPAddr, msgType byte, message string) {
+	key := n.peerNameOrAddr(addr)
+
+	peerErrorsMutex.Lock()
+	defer peerErrorsMutex.Unlock()
+
+	list, found := peerErrors[key]
+	if !found {
+		peerErrorsMakeRoom()
+		list = &peerErrorList{IsAddr: key == addr.String()}
+		peerErrors[key] = list
+	}
+
+	list.Errors = append(list.Errors, peerError{time.Now(), msgType, addr, message})
+	if len(list.Errors) > MAX_RECORDED_ERRORS_PER_PEER {
+		list.Errors = list.Errors[len(list.Errors)-MAX_RECORDED_ERRORS_PER_PEER:]
+	}
+}
+
+// Removes the addresses whose last error is older than PEER_ERRORS_ADDR_TTL, then the key with the oldest last error if there are still MAX_RECORDED_ERROR_SOURCES keys
+// Assumes that peerErrorsMutex is locked
+func peerErrorsMakeRoom() {
+	oldestKey := ""
+	var oldest time.Time
+	for k, list := range peerErrors {
+		last := list.Errors[len(list.Errors)-1].Time
+		if list.IsAddr && time.Since(last) > PEER_ERRORS_ADDR_TTL {
+			delete(peerErrors, k)
+			continue
+		}
+		if oldestKey == "" || last.Before(oldest) {
+			oldestKey = k
+			oldest = last
+		}
+	}
+
+	if len(peerErrors) >= MAX_RECORDED_ERROR_SOURCES {
+		delete(peerErrors, oldestKey)
+	}
+}
+
+// Prints line to stderr unless PEER_ERRORS_PRINT_RATE is reached, the errors are recorded anyway
+func peerErrorsPrint(line string) {
+	peerErrorsMutex.Lock()
+	defer peerErrorsMutex.Unlock()
+
+	if !peerErrorsPrints.take(PEER_ERRORS_PRINT_RATE, PEER_ERRORS_PRINT_BURST) {
+		peerErrorsNotPrinted++
+		LOGGING_FUNC(line)
+		return
+	}
+
+	if peerErrorsNotPrinted > 0 {
+		fmt.Fprintf(os.Stderr, "%d errors received were not printed, see errors\n", peerErrorsNotPrinted)
+		peerErrorsNotPrinted = 0
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
+
+// Prints the errors sent by peerName, or by all peers if peerName is empty
+func printPeerErrors(peerName string) {
+	peerErrorsMutex.Lock()
+	defer peerErrorsMutex.Unlock()
+
+	keys := []string{}
+	for k := range peerErrors {
+		if peerName == "" || k == peerName {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	if len(keys) == 0 {
+		fmt.Println("No error received")
+		return
+	}
+
+	for _, k := range keys {
+		fmt.Println(k + ":")
+		for _, e := range peerErrors[k].Errors {
+			t, _ := byteToMsgTypeAsStr(e.Type)
+			fmt.Printf("\t%s %s from %s: %s\n", e.Time.Format(time.TimeOnly), t, e.Addr.String(), e.Message)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Allows Rate events per second on average and bursts of Burst events
+type tokenBucket struct {
+	Tokens     float64
+	LastRefill time.Time
+}
+
+// Takes a token from the bucket if there is one
+func (b *tokenBucket) take(rate float64, burst float64) bool {
+	now := time.Now()
+	b.Tokens = min(burst, b.Tokens+now.Sub(b.LastRefill).Seconds()*rate)
+	b.LastRefill = now
+
+	if b.Tokens < 1 {
+		return false
+	}
+	b.Tokens--
+	return true
+}
+
+// Buckets and counters of a source of requests (an address or a peer name)
+type requestSource struct {
+	Requests      tokenBucket
+	ErrorReplies  tokenBucket // ErrorReplies telling that the source is limited are limited too, they must be signed
+	NbAccepted    uint64
+	NbLimited     uint64
+	LastRequestAt time.Time
+}
+
+// Protected by a Mutex
+// Keys are addresses as strings for requestSourcesByAddr and peer names for requestSourcesByPeer
+// Sources without request during REQUEST_SOURCE_IDLE_TIMEOUT are removed
+var requestSourcesByAddr map[string]*requestSource
+var requestSourcesByPeer map[string]*requestSource
+var requestSourcesMutex *sync.Mutex
+var requestSourcesLastCleanup time.Time
+
+var requestsDroppedBusyCount atomic.Uint64
+
+// Assumes that requestSourcesMutex is locked
+func requestSourceGet(sources map[string]*requestSource, key string, rate float64, burst float64) *requestSource {
+	source, found := sources[key]
+	if !found {
+		now := time.Now()
+		source = &requestSource{
+			Requests:     tokenBucket{burst, now},
+			ErrorReplies: tokenBucket{RATE_LIMIT_ERROR_REPLY_BURST, now},
+		}
+		sources[key] = source
+	}
+	source.LastRequestAt = time.Now()
+	return source
+}
+
+// Assumes that requestSourcesMutex is locked
+func requestSourcesCleanup() {
+	if time.Since(requestSourcesLastCleanup) < REQUEST_SOURCE_IDLE_TIMEOUT {
+		return
+	}
+	requestSourcesLastCleanup = time.Now()
+
+	for _, sources := range []map[string]*requestSource{requestSourcesByAddr, requestSourcesByPeer} {
+		for k, v := range sources {
+			if time.Since(v.LastRequestAt) > REQUEST_SOURCE_IDLE_TIMEOUT {
+				delete(sources, k)
+			}
+		}
+	}
+}
+
+// Returns the name of the peer that sent the request, or "" if it didn't prove it
+// Anybody can claim a name in an unsigned Hello, so only the name of a verified Hello from the address is used
+// Signatures are not checked here as this must not block, the first Hello from an address is limited by the address only
+func (n *udpNode) requestPeerName(receivedMsg addrUdpMsg) string {
+	liveness, found := n.livenessGet(receivedMsg.Addr)
+	if !found {
+		return ""
+	}
+	return liveness.VerifiedName
+}
+
+// Checks the limits of the address and of the peer that sent the request
+// If a limit is reached, replies with an ErrorReply when the ErrorReply limit of the address allows it and returns false
+func (n *udpNode) requestIsAllowed(receivedMsg addrUdpMsg) bool {
+	peerName := n.requestPeerName(receivedMsg)
+
+	requestSourcesMutex.Lock()
+
+	requestSourcesCleanup()
+
+	addrSource := requestSourceGet(requestSourcesByAddr, receivedMsg.Addr.String(), RATE_LIMIT_ADDR_RATE, RATE_LIMIT_ADDR_BURST)
+	allowed := addrSource.Requests.take(RATE_LIMIT_ADDR_RATE, RATE_LIMIT_ADDR_BURST)
+	reason := "too many requests from your address"
+
+	var peerSource *requestSource
+	if peerName != "" {
+		peerSource = requestSourceGet(requestSourcesByPeer, peerName, RATE_LIMIT_PEER_RATE, RATE_LIMIT_PEER_BURST)
+		if allowed {
+			allowed = peerSource.Requests.take(RATE_LIMIT_PEER_RATE, RATE_LIMIT_PEER_BURST)
+			reason = "too many requests from peer " + peerName
+		}
+	}
+
+	sendErrorReply := false
+	if allowed {
+		addrSource.NbAccepted++
+		if peerSource != nil {
+			peerSource.NbAccepted++
+		}
+	} else {
+		addrSource.NbLimited++
+		if peerSource != nil {
+			peerSource.NbLimited++
+		}
+		sendErrorReply = addrSource.ErrorReplies.take(RATE_LIMIT_ERROR_REPLY_RATE, RATE_LIMIT_ERROR_REPLY_BURST)
+	}
+
+	requestSourcesMutex.Unlock()
+
+	if sendErrorReply {
+		n.replyWithError(receivedMsg, reason)
+	} else if !allowed {
+		LOGGING_FUNC("Dropping request from", receivedMsg.Addr.String()+":", reason)
+	}
+
+	return allowed
+}
+
+// Takes a token from the ErrorReply limit of addr, used for the ErrorReplies to malformed or unsupported requests
+func errorReplyIsAllowed(addr *net.UDPAddr) bool {
+	requestSourcesMutex.Lock()
+	defer requestSourcesMutex.Unlock()
+
+	source := requestSourceGet(requestSourcesByAddr, addr.String(), RATE_LIMIT_ADDR_RATE, RATE_LIMIT_ADDR_BURST)
+	return source.ErrorReplies.take(RATE_LIMIT_ERROR_REPLY_RATE, RATE_LIMIT_ERROR_REPLY_BURST)
+}
+
+// Queues the request for the request workers if the rate limits allow it and the queue is not full
+func (n *udpNode) admitRequest(receivedMsg addrUdpMsg) {
+	if !n.requestIsAllowed(receivedMsg) {
+		return
+	}
+
+	select {
+	case n.requestQueue <- receivedMsg:
+	default:
+		requestsDroppedBusyCount.Add(1)
+		LOGGING_FUNC("Dropping request from", receivedMsg.Addr.String(), "because", REQUEST_QUEUE_SIZE, "requests are waiting to be handled")
+	}
+}
+
+func printRateLimitStats() {
+	fmt.Println("Requests dropped because the request queue was full:", requestsDroppedBusyCount.Load())
+
+	requestSourcesMutex.Lock()
+	defer requestSourcesMutex.Unlock()
+
+	for _, s := range []struct {
+		title   string
+		sources map[string]*requestSource
+	}{{"address", requestSourcesByAddr}, {"peer", requestSourcesByPeer}} {
+		keys := make([]string, 0, len(s.sources))
+		for k := range s.sources {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			v := s.sources[k]
+			fmt.Printf("Requests from %s %s: %d accepted, %d rate limited\n", s.title, k, v.NbAccepted, v.NbLimited)
+		}
+	}
+}
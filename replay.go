@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A signed request already received, with our reply to it
+type replayEntry struct {
+	Id     uint32
+	SeenAt time.Time
+	Reply  *udpMsg // nil while the request is handled or if we didn't reply
+}
+
+// The signed request IDs received from a peer during the last REPLAY_WINDOW_DURATION, at most REPLAY_WINDOW_SIZE of them
+type replayWindow struct {
+	Entries map[uint32]*replayEntry
+	Order   []*replayEntry // Oldest first
+}
+
+// Protected by a Mutex
+// Keys are peer names, or addresses as strings for peers whose name we don't know
+var replayWindows map[string]*replayWindow
+var replayWindowsMutex *sync.Mutex
+var replayWindowsLastCleanup time.Time
+
+// Signed requests whose ID was already received, a cached reply is resent to the ones that are answered
+var replayedRequestsCount atomic.Uint64
+var replayedRequestsAnsweredCount atomic.Uint64
+
+// Assumes that replayWindowsMutex is locked
+func (w *replayWindow) expire(now time.Time) {
+	i := 0
+	for i < len(w.Order) && (now.Sub(w.Order[i].SeenAt) > REPLAY_WINDOW_DURATION || len(w.Order)-i > REPLAY_WINDOW_SIZE) {
+		delete(w.Entries, w.Order[i].Id)
+		i++
+	}
+	w.Order = w.Order[i:]
+}
+
+// Records the ID of a signed request from source
+// Returns true and our previous reply (maybe nil) if it was already received in the window
+func replayCheckRequest(source string, id uint32) (bool, *udpMsg) {
+	replayWindowsMutex.Lock()
+	defer replayWindowsMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(replayWindowsLastCleanup) > REPLAY_WINDOW_DURATION {
+		for k, w := range replayWindows {
+			w.expire(now)
+			if len(w.Order) == 0 {
+				delete(replayWindows, k)
+			}
+		}
+		replayWindowsLastCleanup = now
+	}
+
+	w, found := replayWindows[source]
+	if !found {
+		w = &replayWindow{Entries: make(map[uint32]*replayEntry)}
+		replayWindows[source] = w
+	}
+	w.expire(now)
+
+	entry, found := w.Entries[id]
+	if found {
+		replayedRequestsCount.Add(1)
+		return true, entry.Reply
+	}
+
+	entry = &replayEntry{Id: id, SeenAt: now}
+	w.Entries[id] = entry
+	w.Order = append(w.Order, entry)
+	w.expire(now)
+	return false, nil
+}
+
+// Keeps our reply to the request id of source so that it is resent if the request is received again
+func replayRecordReply(source string, id uint32, reply udpMsg) {
+	replayWindowsMutex.Lock()
+	defer replayWindowsMutex.Unlock()
+
+	w, found := replayWindows[source]
+	if !found {
+		return
+	}
+	entry, found := w.Entries[id]
+	if found {
+		entry.Reply = &reply
+	}
+}
+
+func printReplayStats() {
+	fmt.Println("Signed requests received again:", replayedRequestsCount.Load(), "of which answered with our previous reply:", replayedRequestsAnsweredCount.Load())
+}
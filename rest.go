@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
 	"strings"
+	"time"
 )
 
 // Displays connected peers.
@@ -107,20 +111,106 @@ func restDisplayAllPeersWithTheirAddresses() {
 		for _, a := range addrs {
 			addrOfPeer += a.String() + " "
 		}
-		res += peerName + ": " + addrOfPeer + "\n"
+		res += peerName + peerExtensionsDescription(peerName) + ": " + addrOfPeer + "\n"
 	}
 	fmt.Println(res)
 }
 
-func restGetKey(peerName string) []byte {
+// Returns an empty key if peerName has none or isn't known by the server, and an error if we couldn't ask
+func restGetKey(peerName string) ([]byte, error) {
 	req, body, err := httpGet(SERVER_ADDRESS + PEERS_PATH + peerName + "/key")
 	if err != nil {
-		panic("HTTP REQUEST ERROR")
+		return nil, err
 	}
 
+	if req.StatusCode == HTTP_NO_CONTENT || req.StatusCode == HTTP_NOT_FOUND {
+		return []byte{}, nil
+	}
 	if req.StatusCode != HTTP_OK {
-		return []byte{}
+		return nil, fmt.Errorf("key of %s: HTTP %d", peerName, req.StatusCode)
+	}
+	if len(body) != KEY_SIZE {
+		return nil, fmt.Errorf("key of %s: %d bytes, expected %d", peerName, len(body), KEY_SIZE)
+	}
+
+	traceRecordKey(peerName, body)
+	return body, nil
+}
+
+// PUTs value at /peers/OUR_PEER_NAME/what, signed in the REST_SIGNATURE_HEADER header for the REST server of serve-rest mode
+// The REST server only accepts it once the main peer has received our Hello
+func restPutOurs(what string, value []byte) error {
+	header := http.Header{}
+	header.Set(REST_SIGNATURE_HEADER, hex.EncodeToString(signBytes(value)))
+	resp, body, err := httpPut(SERVER_ADDRESS+PEERS_PATH+OUR_PEER_NAME+"/"+what, value, header)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != HTTP_OK && resp.StatusCode != HTTP_NO_CONTENT {
+		return fmt.Errorf("PUT %s: HTTP %d %s", what, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// Signals restPublisher that our root changed, never blocks
+var restPublishRequests = make(chan struct{}, 1)
+
+func requestRestPublish() {
+	select {
+	case restPublishRequests <- struct{}{}:
+	default: // A publication is already requested, it will use the new root
 	}
+}
+
+// Runs f up to REST_PUBLISH_TRIES times, waiting from REST_PUBLISH_INITIAL_WAIT doubling between tries
+func restRetry(what string, f func() error) error {
+	wait := REST_PUBLISH_INITIAL_WAIT
+	var err error
+	for i := 0; i < REST_PUBLISH_TRIES; i++ {
+		err = f()
+		if err == nil {
+			return nil
+		}
+		LOGGING_FUNC("Try", i+1, "to publish our", what, "failed:", err)
+		if i != REST_PUBLISH_TRIES-1 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	return fmt.Errorf("couldn't publish our %s to the REST server after %d tries: %w", what, REST_PUBLISH_TRIES, err)
+}
 
-	return body
+// Publishes our key once and our root each time requestRestPublish is called, so that peers can get them even if we are unreachable
+func restPublisher() {
+	keyPublished := false
+	for range restPublishRequests {
+		if !keyPublished {
+			err := restRetry("key", func() error { return restPutOurs("key", publicKeyToHexaString()) })
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			} else {
+				keyPublished = true
+				LOGGING_FUNC("Published our key to the REST server")
+			}
+		}
+
+		// The first export requests a publication once our tree is ready
+		tree, _ := ourTreeGet()
+		if tree == nil {
+			continue
+		}
+
+		// Read at each try so that a root changed meanwhile is published directly
+		err := restRetry("root", func() error {
+			tree, _ := ourTreeGet()
+			return restPutOurs("root", tree.Hash)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			LOGGING_FUNC("Published our root to the REST server")
+		}
+	}
 }
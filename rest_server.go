@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protected by a Mutex
+// Keys and roots PUT by the peers to our REST server (serve-rest mode), their addresses are the ones in peers
+var restServerKeys map[string][]byte = make(map[string][]byte)
+var restServerRoots map[string][]byte = make(map[string][]byte)
+var restServerMutex = &sync.Mutex{}
+
+// Protected by restServerMutex
+// Names of the peers that restServerFetchKey is asking for their key
+var restServerKeyFetches map[string]bool = make(map[string]bool)
+
+// True in serve-rest mode
+var restServerOn = false
+
+// Serves the REST API of the main peer with the peers that sent us Hello:
+//   - GET /peers/: names of the peers, one per line
+//   - GET /peers/NAME/addresses: addresses of NAME, one per line
+//   - GET and PUT /peers/NAME/key and /peers/NAME/root
+//
+// Empty path segments are ignored as our client asks for /peers//NAME/addresses
+func runRestServer(listenAddr string) error {
+	restServerMutex.Lock()
+	restServerKeys[OUR_PEER_NAME] = publicKeyToHexaString()
+	// Set by the first export if our tree is not ready yet
+	tree, _ := ourTreeGet()
+	if tree != nil {
+		restServerRoots[OUR_PEER_NAME] = tree.Hash
+	}
+	restServerMutex.Unlock()
+
+	fmt.Println("Serving the REST API on", listenAddr, "as", SERVER_PEER_NAME, "with UDP port", UDP_LISTEN_PORT)
+	return http.ListenAndServe(listenAddr, http.HandlerFunc(restServerHandle))
+}
+
+func restServerHandle(w http.ResponseWriter, r *http.Request) {
+	segments := []string{}
+	for _, s := range strings.Split(r.URL.Path, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+
+	LOGGING_FUNC("REST", r.Method, r.URL.Path, "from", r.RemoteAddr)
+
+	if len(segments) == 0 || segments[0] != strings.Trim(PEERS_PATH, "/") || len(segments) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(segments) == 1 {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		restServerListPeers(w)
+		return
+	}
+
+	peerName := segments[1]
+	addresses := restServerAddressesOf(peerName, r)
+	if len(addresses) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(segments) == 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch segments[2] {
+	case "addresses":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		for _, a := range addresses {
+			fmt.Fprintln(w, a.String())
+		}
+	case "key":
+		restServerKeyOrRoot(w, r, peerName, addresses, restServerKeys, KEY_SIZE)
+	case "root":
+		restServerKeyOrRoot(w, r, peerName, addresses, restServerRoots, HASH_SIZE)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func restServerListPeers(w http.ResponseWriter) {
+	for _, name := range ourNode.peersNames() {
+		fmt.Fprintln(w, name)
+	}
+}
+
+// Our own addresses are the IP the client reached us at with our UDP port, the loopback addresses in peers are useless to others
+func restServerAddressesOf(peerName string, r *http.Request) []*net.UDPAddr {
+	if peerName == OUR_PEER_NAME {
+		localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+		if !ok {
+			return nil
+		}
+		return []*net.UDPAddr{{IP: localAddr.IP, Port: UDP_LISTEN_PORT}}
+	}
+
+	addresses, _ := ourNode.peersGet(peerName)
+	return addresses
+}
+
+// GET returns the value or 204 No Content if there is none
+// PUT is only accepted from an IP of the peer once we have its key, which it proved with a signed Hello (see restServerFetchKey)
+// The key can't be changed, like a pinned key, and a root must be signed with the key in the REST_SIGNATURE_HEADER header
+func restServerKeyOrRoot(w http.ResponseWriter, r *http.Request, peerName string, addresses []*net.UDPAddr, values map[string][]byte, size int) {
+	switch r.Method {
+	case http.MethodGet:
+		restServerMutex.Lock()
+		value, found := values[peerName]
+		restServerMutex.Unlock()
+
+		if !found {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write(value)
+	case http.MethodPut:
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		remoteIP := net.ParseIP(host)
+		fromPeer := false
+		for _, a := range addresses {
+			fromPeer = fromPeer || a.IP.Equal(remoteIP)
+		}
+		if !fromPeer {
+			http.Error(w, "PUT only accepted from an address of "+peerName, http.StatusForbidden)
+			return
+		}
+
+		buffer := make([]byte, size+1)
+		n, _ := io.ReadFull(r.Body, buffer)
+		if n != size {
+			http.Error(w, fmt.Sprintf("expected %d bytes", size), http.StatusBadRequest)
+			return
+		}
+		value := buffer[:n]
+
+		restServerMutex.Lock()
+		defer restServerMutex.Unlock()
+
+		key, found := restServerKeys[peerName]
+		if !found {
+			http.Error(w, "send us a signed Hello first, we then ask the key of "+peerName+" with a PublicKey", http.StatusForbidden)
+			return
+		}
+		if size == KEY_SIZE {
+			if string(key) != string(value) {
+				fmt.Fprintln(os.Stderr, "Refusing to change the key of", peerName, "from", r.RemoteAddr)
+				http.Error(w, "the key of "+peerName+" can't be changed", http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		signature, err := hex.DecodeString(r.Header.Get(REST_SIGNATURE_HEADER))
+		if err != nil || !checkBytesSignature(value, signature, key) {
+			http.Error(w, "the value must be signed with the key of "+peerName+" in the "+REST_SIGNATURE_HEADER+" header", http.StatusForbidden)
+			return
+		}
+		values[peerName] = value
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Called by handleMsg for a signed Hello from peerName whose key we don't have, the Hello is handled again once we have it
+// The key is asked in the background so that the request worker isn't blocked by a peer that doesn't reply
+// The Hello is dropped if the key of peerName is already being asked or if REST_SERVER_MAX_KEY_FETCHES keys are, the peer reemits it
+func (n *udpNode) restServerFetchKeyThenHandle(peerName string, hello addrUdpMsg) {
+	restServerMutex.Lock()
+	if restServerKeyFetches[peerName] || len(restServerKeyFetches) >= REST_SERVER_MAX_KEY_FETCHES {
+		restServerMutex.Unlock()
+		LOGGING_FUNC("Dropping the Hello of", peerName, "while its key or", REST_SERVER_MAX_KEY_FETCHES, "keys are being asked")
+		return
+	}
+	restServerKeyFetches[peerName] = true
+	restServerMutex.Unlock()
+
+	go func() {
+		key := n.restServerFetchKey(peerName, hello)
+
+		restServerMutex.Lock()
+		delete(restServerKeyFetches, peerName)
+		restServerMutex.Unlock()
+
+		if len(key) == KEY_SIZE {
+			n.handleMsg(hello)
+		}
+	}()
+}
+
+// Asks the sender of hello for the key of peerName with a PublicKey
+// The PublicKeyReply must be signed with the key it carries and so must hello, the key is then pinned and served by our REST server
+func (n *udpNode) restServerFetchKey(peerName string, hello addrUdpMsg) []byte {
+	addr := hello.Addr
+	// Unsigned because the peer doesn't know us yet and would refuse a signature it can't check
+	request, replyChan := n.pendingRequestsRegister(addr, udpMsg{Id: rand.Uint32(), Type: PUBLIC_KEY})
+	defer n.pendingRequestsUnregister(addr, request.Id)
+
+	rto := rttGetRto(addr)
+	for i := 0; i < NUMBER_OF_REEMISSIONS+1; i++ {
+		n.simpleSendMsgToAddr(addr, request)
+
+		timer := time.NewTimer(rto)
+		select {
+		case reply := <-replyChan:
+			timer.Stop()
+			key := reply.Msg.Body
+			if reply.Msg.Type != PUBLIC_KEY_REPLY || len(key) != KEY_SIZE || reply.Msg.Signature == nil || !checkMsgSignature(reply.Msg, key) {
+				LOGGING_FUNC("Invalid PublicKeyReply from", addr.String())
+				return []byte{}
+			}
+			if !checkMsgSignature(hello.Msg, key) {
+				LOGGING_FUNC("The Hello of", peerName, "from", addr.String(), "isn't signed with the key it gave us")
+				return []byte{}
+			}
+
+			restServerMutex.Lock()
+			_, found := restServerKeys[peerName]
+			if !found {
+				restServerKeys[peerName] = key
+			}
+			restServerMutex.Unlock()
+
+			key = knownPeersCheck(peerName, key)
+			peerKeysMutex.Lock()
+			peerKeys[peerName] = key
+			peerKeysMutex.Unlock()
+			return key
+		case <-timer.C:
+		}
+		rto = clampRto(2 * rto)
+	}
+
+	return []byte{}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Round-trip time estimation of an address as in RFC 6298
+type rttEstimate struct {
+	Addr       *net.UDPAddr
+	Srtt       time.Duration // Smoothed RTT
+	Rttvar     time.Duration // RTT variation
+	Rto        time.Duration // Time we wait for a reply before the first reemission
+	NbSamples  int
+	LastSample time.Time
+}
+
+// Protected by a Mutex
+// Maps an address as string to its estimate, an address without samples has no key
+var rttEstimates map[string]*rttEstimate
+var rttEstimatesMutex *sync.Mutex
+
+func clampRto(rto time.Duration) time.Duration {
+	return min(max(rto, MIN_RTO), MAX_RTO)
+}
+
+// Returns the time to wait for a reply from addr before reemitting a request
+func rttGetRto(addr *net.UDPAddr) time.Duration {
+	rttEstimatesMutex.Lock()
+	defer rttEstimatesMutex.Unlock()
+
+	estimate, found := rttEstimates[addr.String()]
+	if !found {
+		return INITIAL_RTO
+	}
+	return estimate.Rto
+}
+
+// Returns a copy of the estimate of addr, false if we have no sample for addr
+func rttGet(addr *net.UDPAddr) (rttEstimate, bool) {
+	rttEstimatesMutex.Lock()
+	defer rttEstimatesMutex.Unlock()
+
+	estimate, found := rttEstimates[addr.String()]
+	if !found {
+		return rttEstimate{}, false
+	}
+	return *estimate, true
+}
+
+// Updates the estimate of addr with a new measure
+// Following Karn's rule, sample must come from a request that was not reemitted
+func rttAddSample(addr *net.UDPAddr, sample time.Duration) {
+	rttEstimatesMutex.Lock()
+	defer rttEstimatesMutex.Unlock()
+
+	estimate, found := rttEstimates[addr.String()]
+	if !found {
+		estimate = &rttEstimate{Addr: addr, Srtt: sample, Rttvar: sample / 2}
+		rttEstimates[addr.String()] = estimate
+	} else {
+		diff := estimate.Srtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		// RTTVAR <- (1 - beta) * RTTVAR + beta * |SRTT - R'| then SRTT <- (1 - alpha) * SRTT + alpha * R'
+		estimate.Rttvar = (RTT_BETA_INVERSE-1)*estimate.Rttvar/RTT_BETA_INVERSE + diff/RTT_BETA_INVERSE
+		estimate.Srtt = (RTT_ALPHA_INVERSE-1)*estimate.Srtt/RTT_ALPHA_INVERSE + sample/RTT_ALPHA_INVERSE
+	}
+
+	estimate.Rto = clampRto(estimate.Srtt + max(RTT_CLOCK_GRANULARITY, RTT_K*estimate.Rttvar))
+	estimate.NbSamples++
+	estimate.LastSample = time.Now()
+}
+
+// Returns the smallest RTO among the addresses of peerName, INITIAL_RTO if we have no sample
+func rttGetRtoOfPeer(peerName string) time.Duration {
+	addresses, _ := ourNode.peersGet(peerName)
+
+	res := time.Duration(0)
+	for _, a := range addresses {
+		estimate, found := rttGet(a)
+		if found && (res == 0 || estimate.Rto < res) {
+			res = estimate.Rto
+		}
+	}
+
+	if res == 0 {
+		return INITIAL_RTO
+	}
+	return res
+}
+
+func printRttEstimates() {
+	rttEstimatesMutex.Lock()
+	defer rttEstimatesMutex.Unlock()
+
+	if len(rttEstimates) == 0 {
+		fmt.Println("No RTT sample yet")
+		return
+	}
+
+	addresses := make([]string, 0, len(rttEstimates))
+	for a := range rttEstimates {
+		addresses = append(addresses, a)
+	}
+	sort.Strings(addresses)
+
+	for _, a := range addresses {
+		e := rttEstimates[a]
+		fmt.Printf("%s (%s): SRTT %v, RTTVAR %v, RTO %v, %d samples, last %s ago\n", a, ourNode.peerNameOrAddr(e.Addr), e.Srtt.Round(time.Microsecond), e.Rttvar.Round(time.Microsecond), e.Rto.Round(time.Microsecond), e.NbSamples, time.Since(e.LastSample).Round(time.Second))
+	}
+}
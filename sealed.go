@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peers supporting this extension exchange Sealed[Reply] instead of the requests in SEALABLE_MSGS and their replies
+// The body of a Sealed[Reply] is NONCE || AES-GCM(TYPE || BODY) of the inner message, with the Id and type of the Sealed[Reply] as additional data
+// The key is derived by ECDH from the identity keys, the AEAD authenticates the message so it is not signed
+var EXTENSION_SEALED = extension{1 << 0, "encryption"}
+
+var SEALABLE_MSGS = []byte{ROOT, GET_DATUM}
+
+var errUnseal = errors.New("couldn't unseal message")
+
+// Keys shared with a peer
+type sealedSession struct {
+	PeerKey       []byte // The key of the peer when the session was derived, the session is derived again if it changes
+	Aead          cipher.AEAD
+	EstablishedAt time.Time
+	NbSealed      uint64
+	NbUnsealed    uint64
+	DisabledUntil time.Time // Set when the peer replied in cleartext to a Sealed, we then send cleartext for a while
+}
+
+// Protected by a Mutex
+// Maps a peer name to its session
+var sealedSessions map[string]*sealedSession
+var sealedSessionsMutex *sync.Mutex
+
+// Returns the session with peerName, derived from peerKey, its key given by peerKeysGet, if needed
+// peerKeysGet may ask the REST server so it must be called before locking
+// Assumes that sealedSessionsMutex is locked
+func sealedSessionGet(peerName string, peerKey []byte) (*sealedSession, error) {
+	if len(peerKey) != KEY_SIZE {
+		return nil, fmt.Errorf("no key for %s", peerName)
+	}
+
+	session, found := sealedSessions[peerName]
+	if found && string(session.PeerKey) == string(peerKey) {
+		return session, nil
+	}
+
+	ourEcdhKey, err := privateKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	theirEcdhKey, err := ecdh.P256().NewPublicKey(append([]byte{4}, peerKey...)) // Uncompressed point
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ourEcdhKey.ECDH(theirEcdhKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key := sha256.Sum256(append([]byte("psi sealed v1"), shared...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	session = &sealedSession{PeerKey: peerKey, Aead: aead, EstablishedAt: time.Now()}
+	sealedSessions[peerName] = session
+	LOGGING_FUNC("Derived sealed session with", peerName)
+	return session, nil
+}
+
+// Returns true if a request of type msgType to peerName must be sealed
+func sealedSessionShouldSeal(peerName string, msgType byte) bool {
+	if peerName == "" || !peerSupportsExtension(peerName, EXTENSION_SEALED) {
+		return false
+	}
+
+	if !slices.Contains(SEALABLE_MSGS, msgType) {
+		return false
+	}
+
+	peerKey := peerKeysGet(peerName)
+
+	sealedSessionsMutex.Lock()
+	defer sealedSessionsMutex.Unlock()
+
+	session, err := sealedSessionGet(peerName, peerKey)
+	return err == nil && time.Now().After(session.DisabledUntil)
+}
+
+// Called when peerName replied with a cleartext ErrorReply that it signed to a Sealed, e.g. because it doesn't have our key
+func sealedSessionDisable(peerName string) {
+	sealedSessionsMutex.Lock()
+	defer sealedSessionsMutex.Unlock()
+
+	session, found := sealedSessions[peerName]
+	if found {
+		LOGGING_FUNC("Sending cleartext to", peerName, "for", SEALED_SESSION_DISABLE_DURATION)
+		session.DisabledUntil = time.Now().Add(SEALED_SESSION_DISABLE_DURATION)
+	}
+}
+
+func sealedAdditionalData(id uint32, sealedType byte) []byte {
+	res := make([]byte, ID_SIZE+TYPE_SIZE)
+	binary.BigEndian.PutUint32(res, id)
+	res[ID_SIZE] = sealedType
+	return res
+}
+
+// Seals inner in a message of type sealedType (SEALED or SEALED_REPLY) with the same Id
+func sealMsg(peerName string, inner udpMsg, sealedType byte) (udpMsg, error) {
+	peerKey := peerKeysGet(peerName)
+
+	sealedSessionsMutex.Lock()
+	defer sealedSessionsMutex.Unlock()
+
+	session, err := sealedSessionGet(peerName, peerKey)
+	if err != nil {
+		return udpMsg{}, err
+	}
+
+	nonce := make([]byte, session.Aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return udpMsg{}, err
+	}
+
+	plaintext := append([]byte{inner.Type}, inner.Body...)
+	body := session.Aead.Seal(nonce, nonce, plaintext, sealedAdditionalData(inner.Id, sealedType))
+	session.NbSealed++
+
+	return udpMsg{Id: inner.Id, Type: sealedType, Length: uint16(len(body)), Body: body}, nil
+}
+
+// Returns the message sealed in sealed by peerName, it has no signature as the AEAD authenticates it
+func unsealMsg(peerName string, sealed udpMsg) (udpMsg, error) {
+	peerKey := peerKeysGet(peerName)
+
+	sealedSessionsMutex.Lock()
+	defer sealedSessionsMutex.Unlock()
+
+	session, err := sealedSessionGet(peerName, peerKey)
+	if err != nil {
+		return udpMsg{}, fmt.Errorf("%w: %v", errUnseal, err)
+	}
+
+	nonceSize := session.Aead.NonceSize()
+	if len(sealed.Body) < nonceSize+session.Aead.Overhead()+TYPE_SIZE {
+		return udpMsg{}, fmt.Errorf("%w: body of %d bytes is too short", errUnseal, len(sealed.Body))
+	}
+
+	plaintext, err := session.Aead.Open(nil, sealed.Body[:nonceSize], sealed.Body[nonceSize:], sealedAdditionalData(sealed.Id, sealed.Type))
+	if err != nil {
+		return udpMsg{}, fmt.Errorf("%w: %v", errUnseal, err)
+	}
+	session.NbUnsealed++
+
+	body := plaintext[TYPE_SIZE:]
+	return udpMsg{Id: sealed.Id, Type: plaintext[0], Length: uint16(len(body)), Body: body}, nil
+}
+
+func printSealedSessions() {
+	sealedSessionsMutex.Lock()
+	defer sealedSessionsMutex.Unlock()
+
+	names := make([]string, 0, len(sealedSessions))
+	for name := range sealedSessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		s := sealedSessions[name]
+		state := "encrypted"
+		if time.Now().Before(s.DisabledUntil) {
+			state = fmt.Sprintf("cleartext for %s, the peer refused a Sealed", time.Until(s.DisabledUntil).Round(time.Second))
+		}
+		fmt.Printf("%s: %s since %s, %d sealed and %d unsealed messages\n", name, state, s.EstablishedAt.Format(time.TimeOnly), s.NbSealed, s.NbUnsealed)
+	}
+
+	for _, name := range ourNode.peersNames() {
+		_, found := sealedSessions[name]
+		if !found && name != OUR_PEER_NAME {
+			fmt.Printf("%s: cleartext\n", name)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directions of the entries of a trace file
+const (
+	TRACE_SENT     = "sent"
+	TRACE_RECEIVED = "received"
+	TRACE_KEY      = "key" // A public key we got from the REST server, needed to replay signed messages
+)
+
+// A line of a trace file, in JSON
+// Data is the whole datagram including its signature, or the key for TRACE_KEY
+type traceEntry struct {
+	Time    time.Time `json:"time"`
+	Dir     string    `json:"dir"`
+	Addr    string    `json:"addr,omitempty"`
+	Peer    string    `json:"peer,omitempty"`
+	Type    string    `json:"type,omitempty"`
+	Summary string    `json:"summary,omitempty"`
+	Data    []byte    `json:"data"`
+}
+
+// Set by --trace, nil if we don't record
+var traceEncoder *json.Encoder
+var traceMutex = &sync.Mutex{}
+
+func openTrace(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	traceEncoder = json.NewEncoder(f)
+	return nil
+}
+
+func traceIsOn() bool {
+	return traceEncoder != nil
+}
+
+func traceWrite(entry traceEntry) {
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+
+	err := traceEncoder.Encode(entry)
+	if err != nil {
+		LOGGING_FUNC("Couldn't write trace entry:", err)
+	}
+}
+
+// Records a datagram sent to or received from addr
+func (n *udpNode) traceRecord(dir string, addr *net.UDPAddr, packet []byte) {
+	if !traceIsOn() {
+		return
+	}
+
+	entry := traceEntry{Time: time.Now(), Dir: dir, Addr: addr.String(), Peer: n.peersGetKeyFromVal(addr), Data: append([]byte{}, packet...)}
+	msg, err := byteSliceToUdpMsg(packet, len(packet))
+	if err != nil {
+		entry.Summary = "unparsable: " + err.Error()
+	} else {
+		entry.Type, _ = byteToMsgTypeAsStr(msg.Type)
+		entry.Summary = traceSummary(msg)
+	}
+	traceWrite(entry)
+}
+
+func traceRecordKey(peerName string, key []byte) {
+	if !traceIsOn() {
+		return
+	}
+
+	traceWrite(traceEntry{Time: time.Now(), Dir: TRACE_KEY, Peer: peerName, Data: key})
+}
+
+// One line describing msg without its Id
+func traceSummary(msg udpMsg) string {
+	typeAsString, _ := byteToMsgTypeAsStr(msg.Type)
+	res := fmt.Sprintf("%s length %d", typeAsString, msg.Length)
+	if msg.Signature != nil {
+		res += " signed"
+	}
+
+	shortHex := func(b []byte) string {
+		if len(b) > 8 {
+			b = b[:8]
+		}
+		return hex.EncodeToString(b)
+	}
+
+	switch msg.Type {
+	case HELLO, HELLO_REPLY:
+		h, err := parseHello(msg.Body)
+		if err == nil {
+			res += fmt.Sprintf(" name %q extensions %#x", h.PeerName, h.Extensions)
+		}
+	case ERROR, ERROR_REPLY:
+		res += fmt.Sprintf(" %q", string(msg.Body))
+	case ROOT, ROOT_REPLY, GET_DATUM, NO_DATUM:
+		res += " hash " + shortHex(msg.Body)
+	case DATUM:
+		if len(msg.Body) > int(DATUM_TYPE_INDEX) {
+			datumType, _ := byteToDatumTypeAsStr(msg.Body[DATUM_TYPE_INDEX])
+			res += " " + datumType + " hash " + shortHex(msg.Body)
+		}
+	case NAT_TRAVERSAL_REQUEST, NAT_TRAVERSAL:
+		a, err := byteSliceToUDPAddr(msg.Body)
+		if err == nil {
+			res += " " + a.String()
+		}
+	}
+
+	return res
+}
+
+func readTrace(path string) ([]traceEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []traceEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 4*UDP_BUFFER_SIZE+1024) // Data is in base64
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		var entry traceEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// Filters are KEY=VALUE with KEY among dir, peer, addr and type, an entry must match all of them
+// type is case insensitive and matches both a request and its reply e.g. type=hello matches HELLO and HELLO_REPLY
+func parseTraceFilters(args []string) (func(traceEntry) bool, error) {
+	type filter struct{ key, value string }
+	filters := []filter{}
+	for _, a := range args {
+		key, value, found := strings.Cut(a, "=")
+		if !found || (key != "dir" && key != "peer" && key != "addr" && key != "type") {
+			return nil, fmt.Errorf("invalid filter %q, expected dir=, peer=, addr= or type=", a)
+		}
+		filters = append(filters, filter{key, value})
+	}
+
+	return func(e traceEntry) bool {
+		for _, f := range filters {
+			var ok bool
+			switch f.key {
+			case "dir":
+				ok = e.Dir == f.value
+			case "peer":
+				ok = e.Peer == f.value
+			case "addr":
+				ok = e.Addr == f.value
+			case "type":
+				t := strings.ToUpper(f.value)
+				ok = e.Type == t || e.Type == t+"_REPLY"
+			}
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func traceEntryToString(e traceEntry, start time.Time) string {
+	offset := fmt.Sprintf("%10.3fs", e.Time.Sub(start).Seconds())
+	if e.Dir == TRACE_KEY {
+		return fmt.Sprintf("%s key of %s: %s", offset, e.Peer, hex.EncodeToString(e.Data))
+	}
+
+	arrow := "->"
+	if e.Dir == TRACE_RECEIVED {
+		arrow = "<-"
+	}
+	who := e.Addr
+	if e.Peer != "" {
+		who = e.Peer + " " + e.Addr
+	}
+
+	id := ""
+	if len(e.Data) >= int(ID_SIZE) {
+		id = fmt.Sprintf(" id %d", binary.BigEndian.Uint32(e.Data))
+	}
+
+	return fmt.Sprintf("%s %s %s%s: %s", offset, arrow, who, id, e.Summary)
+}
+
+func printTrace(entries []traceEntry, keep func(traceEntry) bool) {
+	for _, e := range entries {
+		if keep(e) {
+			fmt.Println(traceEntryToString(e, entries[0].Time))
+		}
+	}
+}
+
+// What is compared by diffTraces: everything but the time, the Id, the port and the signature, which change from a run to another
+func traceEntryDiffKey(e traceEntry) string {
+	body := e.Data
+	if e.Dir != TRACE_KEY {
+		msg, err := byteSliceToUdpMsg(e.Data, len(e.Data))
+		if err == nil {
+			body = msg.Body
+		}
+	}
+	hash := sha256.Sum256(body)
+
+	who := e.Peer
+	if who == "" {
+		host, _, _ := net.SplitHostPort(e.Addr)
+		who = host
+	}
+
+	return e.Dir + " " + who + " " + e.Type + " " + hex.EncodeToString(hash[:8])
+}
+
+type diffOp struct {
+	Kind   byte // '=', '-' (only in a) or '+' (only in b)
+	AIndex int
+	BIndex int
+}
+
+// Shortest edit script from a to b (Myers' algorithm)
+func diffStrings(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	maxEdits := n + m
+	offset := maxEdits + 1
+	v := make([]int, 2*maxEdits+3)
+	history := [][]int{}
+
+found:
+	for d := 0; d <= maxEdits; d++ {
+		history = append(history, append([]int{}, v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+				x = v[k+1+offset]
+			} else {
+				x = v[k-1+offset] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+offset] = x
+			if x >= n && y >= m {
+				break found
+			}
+		}
+	}
+
+	ops := []diffOp{}
+	x, y := n, m
+	for d := len(history) - 1; d >= 0; d-- {
+		v := history[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[k-1+offset] < v[k+1+offset]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+offset]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY && x > 0 && y > 0 {
+			x--
+			y--
+			ops = append(ops, diffOp{'=', x, y})
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{'+', x, prevY})
+			} else {
+				ops = append(ops, diffOp{'-', prevX, y})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// Prints the entries only in a with - and the ones only in b with +, returns the number of such entries
+func diffTraces(a, b []traceEntry) int {
+	keysA := make([]string, len(a))
+	for i, e := range a {
+		keysA[i] = traceEntryDiffKey(e)
+	}
+	keysB := make([]string, len(b))
+	for i, e := range b {
+		keysB[i] = traceEntryDiffKey(e)
+	}
+
+	nbDifferences := 0
+	for _, op := range diffStrings(keysA, keysB) {
+		switch op.Kind {
+		case '-':
+			fmt.Println("-", traceEntryToString(a[op.AIndex], a[0].Time))
+			nbDifferences++
+		case '+':
+			fmt.Println("+", traceEntryToString(b[op.BIndex], b[0].Time))
+			nbDifferences++
+		}
+	}
+
+	return nbDifferences
+}
+
+// Replays the trace file at path, see replayTraceEntries
+// Returns an error if it can't be read or if one of our replies differs from the recorded one
+func replayTrace(path string) error {
+	entries, err := readTrace(path)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("empty trace %s", path)
+	}
+
+	nbDifferent := replayTraceEntries(entries)
+	if nbDifferent > 0 {
+		return fmt.Errorf("%d replies differ from the ones recorded in %s", nbDifferent, path)
+	}
+	return nil
+}
+
+// Feeds the datagrams received in entries to byteSliceToUdpMsg and the requests among them to handleMsg
+// Our replies are compared to the ones recorded, ignoring the signatures and our key as the trace may come from another key
+// Replaces the UDP layer with an in-memory network so it must be run before initUdp
+// Returns the number of requests whose reply differs from the recorded one
+func replayTraceEntries(entries []traceEntry) int {
+	network := newMemNetwork(0)
+	ours, err := network.newTransport(
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: UDP_LISTEN_PORT},
+		&net.UDPAddr{IP: net.IPv6loopback, Port: UDP_LISTEN_PORT})
+	checkErrPanic(err)
+	initUdpWithTransport(ours)
+
+	// The REST server is not contacted during a replay, the peers whose key wasn't recorded have no key
+	for _, e := range entries {
+		if e.Dir == TRACE_KEY {
+			peerKeys[e.Peer] = e.Data
+		}
+	}
+	for _, e := range entries {
+		names := []string{e.Peer}
+		msg, err := byteSliceToUdpMsg(e.Data, len(e.Data))
+		if err == nil && (msg.Type == HELLO || msg.Type == HELLO_REPLY) {
+			h, err := parseHello(msg.Body)
+			if err == nil {
+				names = append(names, h.PeerName)
+			}
+		}
+		for _, name := range names {
+			if name != "" && peerKeys[name] == nil {
+				peerKeys[name] = []byte{}
+			}
+		}
+	}
+
+	remotes := make(map[string]*memTransport)
+	nbRequests, nbReplies, nbUnparsable, nbDifferent := 0, 0, 0, 0
+	for i, e := range entries {
+		if e.Dir != TRACE_RECEIVED {
+			continue
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", e.Addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Entry %d: invalid address %s, skipping\n", i, e.Addr)
+			continue
+		}
+
+		msg, err := byteSliceToUdpMsg(e.Data, len(e.Data))
+		if err != nil {
+			nbUnparsable++
+			continue
+		}
+
+		if msg.Type >= FIRST_RESPONSE_MSG_TYPE {
+			// Nobody waits for them, only the parsers are exercised
+			nbReplies++
+			checkMsgIntegrity(msg)
+			continue
+		}
+
+		remote, found := remotes[addr.String()]
+		if !found {
+			remote, err = network.newTransport(addr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Entry %d: %v, skipping\n", i, err)
+				continue
+			}
+			remotes[addr.String()] = remote
+		}
+
+		nbRequests++
+		ourNode.handleMsg(addrUdpMsg{Addr: addr, Msg: msg})
+
+		// Without latency the in-memory network delivers during Send
+		var replayed *udpMsg
+		for replayed == nil {
+			p, ok := remote.tryReceive()
+			if !ok {
+				break
+			}
+			m, err := byteSliceToUdpMsg(p.Data, len(p.Data))
+			if err == nil && m.Id == msg.Id && m.Type >= FIRST_RESPONSE_MSG_TYPE {
+				replayed = &m
+			}
+		}
+
+		recorded := traceFindReply(entries[i+1:], e.Addr, msg.Id)
+		if !replayMatches(recorded, replayed) {
+			nbDifferent++
+			fmt.Println("Different reply to", traceEntryToString(e, entries[0].Time))
+			if recorded != nil {
+				fmt.Println("\trecorded:", traceSummary(*recorded))
+			} else {
+				fmt.Println("\trecorded: no reply")
+			}
+			if replayed != nil {
+				fmt.Println("\treplayed:", traceSummary(*replayed))
+			} else {
+				fmt.Println("\treplayed: no reply")
+			}
+		}
+	}
+
+	fmt.Printf("Replayed %d requests, %d different replies, %d replies and %d unparsable datagrams received\n",
+		nbRequests, nbDifferent, nbReplies, nbUnparsable)
+	return nbDifferent
+}
+
+// Returns the first reply sent to addr with the Id id in entries, nil if there is none
+func traceFindReply(entries []traceEntry, addr string, id uint32) *udpMsg {
+	for _, e := range entries {
+		if e.Dir != TRACE_SENT || e.Addr != addr {
+			continue
+		}
+		msg, err := byteSliceToUdpMsg(e.Data, len(e.Data))
+		if err == nil && msg.Id == id && msg.Type >= FIRST_RESPONSE_MSG_TYPE {
+			return &msg
+		}
+	}
+	return nil
+}
+
+func replayMatches(recorded, replayed *udpMsg) bool {
+	if recorded == nil || replayed == nil {
+		return recorded == replayed
+	}
+	if recorded.Type == PUBLIC_KEY_REPLY {
+		return replayed.Type == PUBLIC_KEY_REPLY && len(recorded.Body) == len(replayed.Body)
+	}
+	return recorded.Type == replayed.Type && string(recorded.Body) == string(replayed.Body)
+}
+
+// trace show FILE [FILTER...], trace diff FILE1 FILE2 or trace replay FILE
+// Returns the exit status, 1 if there is an error or a difference
+func runTraceCommand(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "Usage: trace show FILE [dir=|peer=|addr=|type=...], trace diff FILE1 FILE2 or trace replay FILE")
+		return 1
+	}
+
+	entries, err := readTrace(args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(os.Stderr, "Empty trace", args[1])
+		return 1
+	}
+
+	switch args[0] {
+	case "show":
+		keep, err := parseTraceFilters(args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printTrace(entries, keep)
+	case "diff":
+		if len(args) < 3 {
+			fmt.Fprintln(os.Stderr, "trace diff requires two files")
+			return 1
+		}
+		otherEntries, err := readTrace(args[2])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(otherEntries) == 0 {
+			fmt.Fprintln(os.Stderr, "Empty trace", args[2])
+			return 1
+		}
+		if diffTraces(entries, otherEntries) > 0 {
+			return 1
+		}
+	case "replay":
+		err = replayTrace(args[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown trace subcommand", args[0])
+		return 1
+	}
+
+	return 0
+}
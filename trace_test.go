@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// The files that peer A shared when testdata/two_peers.trace was recorded
+// The trace has Hello, PublicKey, Root, GetDatum of every datum and of an unknown hash, a malformed GetDatum, an unsupported request, a reply and an unparsable datagram, all from peer B
+var traceTestSharedFiles = map[string][]byte{
+	"hello.txt": []byte("hello\n"),
+	"dir/data":  bytes.Repeat([]byte("0123456789abcdef"), 200),
+}
+
+// Our replies to the requests of the recorded trace must not change
+func TestReplayTrace(t *testing.T) {
+	path, err := filepath.Abs(filepath.Join("testdata", "two_peers.trace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chdirToTestRun(t, traceTestSharedFiles)
+	setTestKeys(t)
+	OUR_PEER_NAME = "A"
+
+	_, err = exportMerkleTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = replayTrace(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiffStrings(t *testing.T) {
+	a := []string{"hello", "root", "datum", "datum"}
+	b := []string{"hello", "datum", "error", "datum"}
+
+	res := ""
+	for _, op := range diffStrings(a, b) {
+		res += string(op.Kind)
+	}
+	if res != "=-=+=" {
+		t.Fatalf("edit script %s, expected =-=+=", res)
+	}
+}
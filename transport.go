@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Sends and receives the datagrams of the UDP layer
+// udpTransport uses real sockets, memTransport an in-memory network
+type transport interface {
+	// Sends packet to addr without waiting for anything
+	Send(packet []byte, addr *net.UDPAddr) error
+
+	// Returns true if we can send to the family (IPv4 or IPv6) of addr
+	CanReach(addr *net.UDPAddr) bool
+
+	// Addresses through which the transport can reach itself e.g. loopback addresses
+	LocalAddrs() []*net.UDPAddr
+
+	// Receives datagrams until the transport is closed and calls deliver for each of them
+	// deliver must not block and must not keep packet after returning
+	Serve(deliver func(packet []byte, addr *net.UDPAddr))
+
+	Close() error
+}
+
+// Buffers of UDP_BUFFER_SIZE bytes to receive datagrams, as *[]byte
+var udpBufferPool = sync.Pool{New: func() any {
+	buffer := make([]byte, UDP_BUFFER_SIZE)
+	return &buffer
+}}
+
+type udpTransport struct {
+	// The sockets bound to the port, each family may have several descriptors of its socket (see listenUdpSockets)
+	// The first of each family is used to send
+	connsIPv4 []*net.UDPConn
+	connsIPv6 []*net.UDPConn // Empty if the host has no IPv6 connectivity, IPv6 addresses are then skipped
+	port      int
+}
+
+func newUdpTransport(port int) (*udpTransport, error) {
+	t := &udpTransport{port: port}
+
+	v4ListenAddr, err := net.ResolveUDPAddr("udp4", ":"+fmt.Sprint(port))
+	if err != nil {
+		return nil, err
+	}
+	LOGGING_FUNC("Binding", v4ListenAddr.String())
+
+	t.connsIPv4, err = listenUdpSockets("udp4", v4ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The udp6 sockets are IPv6 only so they don't conflict with the udp4 sockets bound to the same port
+	v6ListenAddr, err := net.ResolveUDPAddr("udp6", ":"+fmt.Sprint(port))
+	if err != nil {
+		return nil, err
+	}
+	LOGGING_FUNC("Binding", v6ListenAddr.String())
+
+	t.connsIPv6, err = listenUdpSockets("udp6", v6ListenAddr)
+	if err != nil {
+		LOGGING_FUNC("IPv6 unavailable, only IPv4 will be used:", err)
+		t.connsIPv6 = nil
+	}
+
+	return t, nil
+}
+
+// Returns the socket to use to communicate with addr
+func (t *udpTransport) connForAddr(addr *net.UDPAddr) (*net.UDPConn, error) {
+	if addr.IP.To4() != nil {
+		return t.connsIPv4[0], nil
+	}
+
+	if len(t.connsIPv6) == 0 {
+		return nil, fmt.Errorf("can't send to %s: IPv6 is unavailable", addr.String())
+	}
+
+	return t.connsIPv6[0], nil
+}
+
+func (t *udpTransport) Send(packet []byte, addr *net.UDPAddr) error {
+	conn, err := t.connForAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	// TODO Verify number of bytes written and underscores everywhere in the code
+	_, err = conn.WriteToUDP(packet, addr)
+	return err
+}
+
+func (t *udpTransport) CanReach(addr *net.UDPAddr) bool {
+	_, err := t.connForAddr(addr)
+	return err == nil
+}
+
+func (t *udpTransport) LocalAddrs() []*net.UDPAddr {
+	res := []*net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: t.port}}
+	if len(t.connsIPv6) > 0 {
+		res = append(res, &net.UDPAddr{IP: net.IPv6loopback, Port: t.port})
+	}
+	return res
+}
+
+func (t *udpTransport) Serve(deliver func(packet []byte, addr *net.UDPAddr)) {
+	var wg sync.WaitGroup
+	for _, conn := range append(append([]*net.UDPConn{}, t.connsIPv4...), t.connsIPv6...) {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			receiveLoop(conn, deliver)
+		}(conn)
+	}
+	wg.Wait()
+}
+
+func (t *udpTransport) Close() error {
+	var err error
+	for _, conn := range append(append([]*net.UDPConn{}, t.connsIPv4...), t.connsIPv6...) {
+		closeErr := conn.Close()
+		if closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Reads datagrams one by one in buffers of udpBufferPool, used when batched reads aren't available
+func receiveLoopOneByOne(conn *net.UDPConn, deliver func(packet []byte, addr *net.UDPAddr)) {
+	for {
+		buffer := udpBufferPool.Get().(*[]byte)
+
+		bytesRead, peerAddr, err := conn.ReadFromUDP(*buffer)
+		if err == nil {
+			deliver((*buffer)[:bytesRead], peerAddr)
+		}
+
+		udpBufferPool.Put(buffer)
+
+		if err != nil {
+			LOGGING_FUNC(err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// In-memory network connecting memTransports, used to run the UDP layer without sockets e.g. to test it or replay traces
+// The faults are applied independently to each datagram
+type memNetwork struct {
+	LossRate        float64       // Probability that a datagram is dropped
+	DuplicationRate float64       // Probability that a datagram is delivered twice
+	ReorderRate     float64       // Probability that a datagram is delayed by ReorderDelay more than the others
+	Latency         time.Duration // Delay of every datagram
+	Jitter          time.Duration // Random delay between 0 and Jitter added to Latency
+	ReorderDelay    time.Duration
+
+	mutex     *sync.Mutex // Protects endpoints, rng and nbDropped
+	endpoints map[string]*memTransport
+	rng       *rand.Rand
+	nbDropped int // Datagrams dropped because of LossRate
+}
+
+type memPacket struct {
+	Data []byte
+	From *net.UDPAddr
+}
+
+// An endpoint of a memNetwork, it has at most one address per family
+type memTransport struct {
+	network *memNetwork
+	addrs   []*net.UDPAddr
+	inbox   chan memPacket
+	closed  chan struct{}
+	once    *sync.Once
+}
+
+func newMemNetwork(seed int64) *memNetwork {
+	return &memNetwork{
+		mutex:     &sync.Mutex{},
+		endpoints: make(map[string]*memTransport),
+		rng:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Creates an endpoint reachable at addrs
+func (n *memNetwork) newTransport(addrs ...*net.UDPAddr) (*memTransport, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for _, a := range addrs {
+		_, found := n.endpoints[a.String()]
+		if found {
+			return nil, fmt.Errorf("address %s already used in the in-memory network", a.String())
+		}
+	}
+
+	t := &memTransport{n, addrs, make(chan memPacket, MEM_TRANSPORT_INBOX_SIZE), make(chan struct{}), &sync.Once{}}
+	for _, a := range addrs {
+		n.endpoints[a.String()] = t
+	}
+	return t, nil
+}
+
+// Returns the address of t of the family of addr, nil if there is none
+func (t *memTransport) addrForFamilyOf(addr *net.UDPAddr) *net.UDPAddr {
+	for _, a := range t.addrs {
+		if (a.IP.To4() != nil) == (addr.IP.To4() != nil) {
+			return a
+		}
+	}
+	return nil
+}
+
+func (t *memTransport) Send(packet []byte, addr *net.UDPAddr) error {
+	from := t.addrForFamilyOf(addr)
+	if from == nil {
+		return fmt.Errorf("can't send to %s: no address of its family", addr.String())
+	}
+
+	n := t.network
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	dest, found := n.endpoints[addr.String()]
+	if !found { // Like UDP, sending to nobody is not an error
+		return nil
+	}
+
+	nbCopies := 1
+	if n.rng.Float64() < n.DuplicationRate {
+		nbCopies = 2
+	}
+
+	for i := 0; i < nbCopies; i++ {
+		if n.rng.Float64() < n.LossRate {
+			n.nbDropped++
+			continue
+		}
+
+		delay := n.Latency
+		if n.Jitter > 0 {
+			delay += time.Duration(n.rng.Int63n(int64(n.Jitter)))
+		}
+		if n.rng.Float64() < n.ReorderRate {
+			delay += n.ReorderDelay
+		}
+
+		p := memPacket{append([]byte{}, packet...), from}
+		if delay == 0 {
+			dest.push(p)
+		} else {
+			time.AfterFunc(delay, func() { dest.push(p) })
+		}
+	}
+
+	return nil
+}
+
+// Returns the number of datagrams dropped because of LossRate
+func (n *memNetwork) dropped() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.nbDropped
+}
+
+// Like a socket buffer, drops the packet if the inbox is full
+func (t *memTransport) push(p memPacket) {
+	select {
+	case <-t.closed:
+	case t.inbox <- p:
+	default:
+	}
+}
+
+func (t *memTransport) CanReach(addr *net.UDPAddr) bool {
+	return t.addrForFamilyOf(addr) != nil
+}
+
+func (t *memTransport) LocalAddrs() []*net.UDPAddr {
+	return t.addrs
+}
+
+func (t *memTransport) Serve(deliver func(packet []byte, addr *net.UDPAddr)) {
+	for {
+		p, err := t.Receive()
+		if err != nil {
+			return
+		}
+		deliver(p.Data, p.From)
+	}
+}
+
+// Waits for the next datagram, can be used instead of Serve to drive an endpoint by hand
+func (t *memTransport) Receive() (memPacket, error) {
+	select {
+	case <-t.closed:
+		return memPacket{}, net.ErrClosed
+	case p := <-t.inbox:
+		return p, nil
+	}
+}
+
+// Like Receive but returns false instead of waiting if there is no datagram
+func (t *memTransport) tryReceive() (memPacket, bool) {
+	select {
+	case p := <-t.inbox:
+		return p, true
+	default:
+		return memPacket{}, false
+	}
+}
+
+func (t *memTransport) Close() error {
+	t.once.Do(func() {
+		t.network.mutex.Lock()
+		for _, a := range t.addrs {
+			delete(t.network.endpoints, a.String())
+		}
+		t.network.mutex.Unlock()
+		close(t.closed)
+	})
+	return nil
+}
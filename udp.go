@@ -1,57 +1,108 @@
 package main
 
 import (
-	"container/list"
 	"fmt"
+	"math/rand"
 	"net"
-	"os"
 	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var connIPv4 *net.UDPConn
-
-//var connIPv6 *net.UDPConn // TODO Implement IPv6 e.g. use the right conn according to the IP address (v4 or v6 of the query)
+// A node of the network: its transport, the requests it waits a reply for, its peers and what it knows about their addresses
+// The program runs ourNode, tests can run several nodes over a memNetwork
+// What is not in a node e.g. keys, RTT estimates and rate limits is shared by the nodes of the process
+type udpNode struct {
+	Name      string // Sent in our Hellos
+	transport transport
+
+	// Requests admitted by admitRequest, handled by NB_REQUEST_WORKERS goroutines
+	requestQueue chan addrUdpMsg
+
+	// Protected by a RWMutex
+	// If we received a Hello we send HelloReply and we assume the address is valid and add it to this map
+	// If we have sent a Hello and received a HelloReply we consider the address valid and add it to this map
+	// If we don't receive a reply to a request after NUMBER_OF_REEMISSIONS we consider the address invalid and remove it from this map (and the key if the slice becomes empty)
+	// If we receive nothing from an address during PEER_ADDRESS_TTL, keepAlivePeers removes it from this map
+	peers      map[string][]*net.UDPAddr
+	peersMutex *sync.RWMutex
+
+	// Protected by a Mutex
+	// When we send a request we add its key with a channel, handleMsg sends the reply in the channel if the key is present
+	// The key is removed by the sender once it received a reply or gave up, so a reply that nobody waits for is dropped
+	// Two requests in flight to the same address never have the same ID
+	pendingRequests      map[pendingRequestKey]chan addrUdpMsg
+	pendingRequestsMutex *sync.Mutex
+
+	// Number of replies received that didn't match any request in flight
+	unsolicitedRepliesCount atomic.Uint64
+
+	// Protected by a Mutex
+	// Maps an address as string to its liveness
+	addrLivenesses      map[string]*addrLiveness
+	addrLivenessesMutex *sync.Mutex
+
+	// Protected by a Mutex
+	// Maps a peer name to the address that replied first to our Hellos, it is also in n.peers
+	preferredAddrs      map[string]*net.UDPAddr
+	preferredAddrsMutex *sync.Mutex
+
+	// Protected by a Mutex
+	// Maps an address as string to the NAT traversal in progress towards it
+	natTraversals      map[string]*natTraversalState
+	natTraversalsMutex *sync.Mutex
+
+	// Protected by a Mutex
+	// Maps a peer name to the connection in progress to it, see connectToPeer
+	connections      map[string]*peerConnection
+	connectionsMutex *sync.Mutex
+
+	// Our IPv4 NAT type, see detectNatType
+	natType atomic.Int32
+}
 
-// TODO Send ErrorReply
+// Set by initUdp or initUdpWithTransport
+var ourNode *udpNode
 
 // Protected by a RWMutex
-// If we received a Hello we send HelloReply and we assume the address is valid and add it to this map
-// If we have sent a Hello and received a HelloReply we consider the address valid and add it to this map
-// If we don't receive a reply to a request after NUMBER_OF_REEMISSIONS we consider the address invalid and remove it from this map (and the key if the slice becomes empty)
-// We don't remove an address from this map after 180 s with nothing sent or received
-var peers map[string][]*net.UDPAddr
-var peersMutex *sync.RWMutex
-
+// peerKeys caches the keys we got, see peerKeysGet for the other two
 var peerKeys map[string][]byte
+var peerKeyLookups map[string]*peerKeyLookup
+var peerKeyFailures map[string]peerKeyFailure
 var peerKeysMutex *sync.RWMutex
 
 type addrUdpMsg struct {
-	Addr *net.UDPAddr
-	Msg  udpMsg
+	Addr     *net.UDPAddr
+	Msg      udpMsg
+	SealedBy string // Peer whose session sealed Msg, the replies to it are sealed too, empty for cleartext
 }
 
-// TODO Replace msgQueue with a map whose keys are struct {*net.UDPAddr, uint32 (Msg.Id)} and value is *udpMsg. When we sent a request we add the corresponding key with a nil value and wait for the value to become not nil, we then retrieve the value and remove the key
-// If replies are sent when we haven't made a request, the replies accumulate forever in the message queue (fixed by the above task)
-var msgQueue *list.List
-var msgQueueMutex *sync.RWMutex
+// Identifies a request we sent and are waiting a reply for
+// Addr is the string representation of the destination address so that two *net.UDPAddr of the same address give the same key
+type pendingRequestKey struct {
+	Addr string
+	Id   uint32
+}
+
+func (n *udpNode) peersAddAddr(peerName string, addr *net.UDPAddr) {
+	n.peersCreateKeyValuePairIfNotExist(peerName)
 
-func peersAddAddr(peerName string, addr *net.UDPAddr) {
-	peersCreateKeyValuePairIfNotExist(peerName)
+	_ = n.peersRemoveAddr(peerName, addr)
 
-	_ = peersRemoveAddr(peerName, addr)
+	n.peersMutex.Lock()
+	n.peers[peerName] = append(n.peers[peerName], addr)
+	n.peersMutex.Unlock()
 
-	peersMutex.Lock()
-	peers[peerName] = append(peers[peerName], addr)
-	peersMutex.Unlock()
+	n.livenessOnPeersAdd(addr)
 }
 
-func peersGet(key string) ([]*net.UDPAddr, bool) {
-	peersMutex.RLock()
-	defer peersMutex.RUnlock()
+func (n *udpNode) peersGet(key string) ([]*net.UDPAddr, bool) {
+	n.peersMutex.RLock()
+	defer n.peersMutex.RUnlock()
 
-	value, found := peers[key]
+	value, found := n.peers[key]
 	return value, found
 }
 
@@ -64,11 +115,11 @@ func removeFromAddrSlice(slice []*net.UDPAddr, index int) []*net.UDPAddr {
 }
 
 // Removes the key if the value slice becomes empty
-func peersRemoveAddr(peerName string, addrToRemove *net.UDPAddr) error {
-	peersMutex.Lock()
-	defer peersMutex.Unlock()
+func (n *udpNode) peersRemoveAddr(peerName string, addrToRemove *net.UDPAddr) error {
+	n.peersMutex.Lock()
+	defer n.peersMutex.Unlock()
 
-	addresses, valueFound := peers[peerName]
+	addresses, valueFound := n.peers[peerName]
 	if !valueFound {
 		return fmt.Errorf("peer not found when trying to remove one of its addresses")
 	}
@@ -85,29 +136,44 @@ func peersRemoveAddr(peerName string, addrToRemove *net.UDPAddr) error {
 		return fmt.Errorf("address to remove not found")
 	}
 
-	peers[peerName] = removeFromAddrSlice(addresses, indexToRemove)
+	n.peers[peerName] = removeFromAddrSlice(addresses, indexToRemove)
 
-	if len(peers[peerName]) == 0 {
-		delete(peers, peerName)
+	if len(n.peers[peerName]) == 0 {
+		delete(n.peers, peerName)
 	}
 
 	return nil
 }
 
-func peersCreateKeyValuePairIfNotExist(peerName string) {
-	peersMutex.Lock()
-	_, found := peers[peerName]
+func (n *udpNode) peersCreateKeyValuePairIfNotExist(peerName string) {
+	n.peersMutex.Lock()
+	_, found := n.peers[peerName]
 	if !found {
-		peers[peerName] = []*net.UDPAddr{}
+		n.peers[peerName] = []*net.UDPAddr{}
 	}
-	peersMutex.Unlock()
+	n.peersMutex.Unlock()
 }
 
-func peersGetKeyFromVal(addr *net.UDPAddr) string {
-	peersMutex.RLock()
-	defer peersMutex.RUnlock()
+// Returns the names of the peers that have an address, sorted
+func (n *udpNode) peersNames() []string {
+	n.peersMutex.RLock()
+	names := make([]string, 0, len(n.peers))
+	for name, addresses := range n.peers {
+		if len(addresses) > 0 {
+			names = append(names, name)
+		}
+	}
+	n.peersMutex.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
 
-	for k, v := range peers {
+func (n *udpNode) peersGetKeyFromVal(addr *net.UDPAddr) string {
+	n.peersMutex.RLock()
+	defer n.peersMutex.RUnlock()
+
+	for k, v := range n.peers {
 		if addrIsInSlice(v, addr) {
 			return k
 		}
@@ -115,172 +181,297 @@ func peersGetKeyFromVal(addr *net.UDPAddr) string {
 	return ""
 }
 
+// Binds UDP_LISTEN_PORT and initializes the UDP layer
 func initUdp() error {
-	msgQueue = list.New()
-	msgQueueMutex = &sync.RWMutex{}
+	t, err := newUdpTransport(UDP_LISTEN_PORT)
+	if err != nil {
+		return err
+	}
 
-	peers = make(map[string][]*net.UDPAddr)
-	peersMutex = &sync.RWMutex{}
+	initUdpWithTransport(t)
+	return nil
+}
 
+// Initializes the UDP layer to send and receive with t e.g. a memTransport, ourNode is then a node named OUR_PEER_NAME
+func initUdpWithTransport(t transport) {
 	peerKeys = make(map[string][]byte)
+	peerKeyLookups = make(map[string]*peerKeyLookup)
+	peerKeyFailures = make(map[string]peerKeyFailure)
 	peerKeysMutex = &sync.RWMutex{}
 
-	v4ListenAddr, err := net.ResolveUDPAddr("udp4", ":"+fmt.Sprint(UDP_LISTEN_PORT))
-	if err != nil {
-		return err
-	}
-	LOGGING_FUNC("Binding", v4ListenAddr.String())
+	peerExtensions = make(map[string]uint32)
+	peerExtensionsMutex = &sync.RWMutex{}
 
-	peersAddAddr(OUR_PEER_NAME, &net.UDPAddr{IP: []byte{127, 0, 0, 1}, Port: UDP_LISTEN_PORT})
+	peerErrors = make(map[string]*peerErrorList)
+	peerErrorsMutex = &sync.Mutex{}
+	peerErrorsPrints = tokenBucket{PEER_ERRORS_PRINT_BURST, time.Now()}
+	peerErrorsNotPrinted = 0
 
-	/*v6ListenAddr, err := net.ResolveUDPAddr("udp6", ":"+fmt.Sprint(UDP_LISTEN_PORT))
-	  if err != nil {
-	      return err
-	  }
-	  LOGGING_FUNC("Binding", v6ListenAddr.String())*/
+	rttEstimates = make(map[string]*rttEstimate)
+	rttEstimatesMutex = &sync.Mutex{}
 
-	connIPv4, err = net.ListenUDP("udp4", v4ListenAddr)
-	if err != nil {
-		return err
-	}
+	congestionWindows = make(map[string]*congestionWindow)
+	congestionWindowsMutex = &sync.Mutex{}
 
-	/*connIPv6, err = net.ListenUDP("udp6", v6ListenAddr)
-	  if err != nil {
-	      return err
-	  }*/
+	replayWindows = make(map[string]*replayWindow)
+	replayWindowsMutex = &sync.Mutex{}
 
-	return nil
+	sealedSessions = make(map[string]*sealedSession)
+	sealedSessionsMutex = &sync.Mutex{}
+
+	ourObservedAddrs = nil
+	ourObservedAddrsMutex = &sync.Mutex{}
+
+	requestSourcesByAddr = make(map[string]*requestSource)
+	requestSourcesByPeer = make(map[string]*requestSource)
+	requestSourcesMutex = &sync.Mutex{}
+
+	ourNode = newUdpNode(OUR_PEER_NAME, t)
 }
 
-// This function is internal to udp.go, used to receive all messages
-// Called only by listenAndRespond
-// Will return the message normally even for invalid messages e.g. Hello with empty body
-func receiveAnyMsg() (addrUdpMsg, error) {
-	buffer := make([]byte, UDP_BUFFER_SIZE)
+// Creates a node named name that sends and receives with t, initUdpWithTransport must have been called
+func newUdpNode(name string, t transport) *udpNode {
+	n := &udpNode{
+		Name:                 name,
+		transport:            t,
+		requestQueue:         make(chan addrUdpMsg, REQUEST_QUEUE_SIZE),
+		peers:                make(map[string][]*net.UDPAddr),
+		peersMutex:           &sync.RWMutex{},
+		pendingRequests:      make(map[pendingRequestKey]chan addrUdpMsg),
+		pendingRequestsMutex: &sync.Mutex{},
+		addrLivenesses:       make(map[string]*addrLiveness),
+		addrLivenessesMutex:  &sync.Mutex{},
+		preferredAddrs:       make(map[string]*net.UDPAddr),
+		preferredAddrsMutex:  &sync.Mutex{},
+		natTraversals:        make(map[string]*natTraversalState),
+		natTraversalsMutex:   &sync.Mutex{},
+		connections:          make(map[string]*peerConnection),
+		connectionsMutex:     &sync.Mutex{},
+	}
+
+	for _, a := range t.LocalAddrs() {
+		n.peersAddAddr(name, a)
+	}
+	return n
+}
 
-	bytesRead, peerAddr, err := connIPv4.ReadFromUDP(buffer)
-	if err != nil {
-		return addrUdpMsg{}, err
-	}
+// Returns true if we can send to the family of addr
+func (n *udpNode) udpAddrIsReachable(addr *net.UDPAddr) bool {
+	return n.transport.CanReach(addr)
+}
+
+// Called by the transport for each datagram received, must not block
+// Invalid messages e.g. Hello with empty body are dispatched normally
+func (n *udpNode) receivePacket(packet []byte, addr *net.UDPAddr) {
+	n.traceRecord(TRACE_RECEIVED, addr, packet)
 
-	receivedMsg, err := byteSliceToUdpMsg(buffer, bytesRead)
+	receivedMsg, err := byteSliceToUdpMsg(packet, len(packet)) // Copies what it keeps from packet
 	if err != nil {
-		return addrUdpMsg{}, err
+		LOGGING_FUNC(err)
+		return
 	}
 
-	return addrUdpMsg{peerAddr, receivedMsg}, nil
+	n.dispatchMsg(addrUdpMsg{Addr: addr, Msg: receivedMsg})
 }
 
 // Send a message and do not wait for a reply
-func simpleSendMsgToAddr(peerAddr *net.UDPAddr, toSend udpMsg) error {
-	// TODO Verify number of bytes written and underscores everywhere in the code
-	_, err := connIPv4.WriteToUDP(udpMsgToByteSlice(toSend), peerAddr)
-	return err
+func (n *udpNode) simpleSendMsgToAddr(peerAddr *net.UDPAddr, toSend udpMsg) error {
+	n.livenessOnSend(peerAddr, toSend.Type)
+
+	packet := udpMsgToByteSlice(toSend)
+	n.traceRecord(TRACE_SENT, peerAddr, packet)
+	return n.transport.Send(packet, peerAddr)
 }
 
-// Internal to udp.go
-func handleMsg(receivedMsg addrUdpMsg) {
+// Gives a received message to the goroutine waiting for it if it is a reply, or to the request workers
+// Must not block
+func (n *udpNode) dispatchMsg(receivedMsg addrUdpMsg) {
+	n.livenessOnReceive(receivedMsg.Addr, receivedMsg.Msg.Type)
+
 	if receivedMsg.Msg.Type >= FIRST_RESPONSE_MSG_TYPE {
-		LOGGING_FUNC("Appending to msgQueue", udpMsgToStringShort(receivedMsg.Msg))
-		threadSafeAppendToList(msgQueue, msgQueueMutex, receivedMsg)
+		if !n.pendingRequestsDeliver(receivedMsg) {
+			n.unsolicitedRepliesCount.Add(1)
+			LOGGING_FUNC("Dropping unsolicited reply from", receivedMsg.Addr.String(), udpMsgToStringShort(receivedMsg.Msg))
+		}
 		return
 	}
 
-	// The received message is a request
+	n.admitRequest(receivedMsg)
+}
+
+// Internal to udp.go
+// receivedMsg is a request
+func (n *udpNode) handleMsg(receivedMsg addrUdpMsg) {
 	err := checkMsgIntegrity(receivedMsg.Msg)
 	if err != nil {
-		LOGGING_FUNC("not replying to invalid request received: " + udpMsgToString(receivedMsg.Msg))
+		LOGGING_FUNC("invalid request received: " + udpMsgToString(receivedMsg.Msg))
+		// The source address can be spoofed, the ErrorReply limit of the address bounds what we reflect to it
+		if errorReplyIsAllowed(receivedMsg.Addr) {
+			n.replyWithError(receivedMsg, err.Error())
+		}
 		return
 	}
 
+	// The sealed request is handled as if it was received in cleartext, except that it is authenticated by the session
+	if receivedMsg.Msg.Type == SEALED {
+		sealedBy := n.peersGetKeyFromVal(receivedMsg.Addr)
+		if sealedBy == "" {
+			n.replyWithError(receivedMsg, "Sealed from an unknown address, send Hello first")
+			return
+		}
+		inner, err := unsealMsg(sealedBy, receivedMsg.Msg)
+		if err != nil {
+			n.replyWithError(receivedMsg, err.Error())
+			return
+		}
+		if !slices.Contains(SEALABLE_MSGS, inner.Type) {
+			t, _ := byteToMsgTypeAsStr(inner.Type)
+			n.replyWithError(receivedMsg, "type "+t+" can't be sealed")
+			return
+		}
+		receivedMsg.Msg = inner
+		receivedMsg.SealedBy = sealedBy
+
+		err = checkMsgIntegrity(receivedMsg.Msg)
+		if err != nil {
+			n.replyWithError(receivedMsg, err.Error())
+			return
+		}
+	}
+
 	var peerName string
 	if receivedMsg.Msg.Type == HELLO {
 		hello, _ := parseHello(receivedMsg.Msg.Body)
 		peerName = hello.PeerName
 	} else {
-		peerName = peersGetKeyFromVal(receivedMsg.Addr)
+		peerName = n.peersGetKeyFromVal(receivedMsg.Addr)
 	}
 
 	peerPublicKey := []byte{}
 	if peerName != "" {
-		peerKeysMutex.Lock()
-		v, f := peerKeys[peerName]
-		if f {
-			peerPublicKey = v
-		} else {
-			peerPublicKey = restGetKey(peerName)
-			peerKeys[peerName] = peerPublicKey
-		}
-		peerKeysMutex.Unlock()
+		peerPublicKey = peerKeysGet(peerName)
+	}
+
+	// As the main peer we are the REST server, so a new peer can only give us its key over UDP
+	if restServerOn && receivedMsg.Msg.Type == HELLO && receivedMsg.Msg.Signature != nil && len(peerPublicKey) != KEY_SIZE {
+		n.restServerFetchKeyThenHandle(peerName, receivedMsg)
+		return
 	}
 
 	if receivedMsg.Msg.Signature != nil {
 		if len(peerPublicKey) == KEY_SIZE {
 			if !checkMsgSignature(receivedMsg.Msg, peerPublicKey) {
-				LOGGING_FUNC("Bad signature in received request")
+				n.replyWithError(receivedMsg, "bad signature")
 				return
 			} else {
 				LOGGING_FUNC("Successfully verified signature of request")
+				if receivedMsg.Msg.Type == HELLO {
+					n.livenessOnVerifiedHello(receivedMsg.Addr, peerName)
+				}
 			}
 		} else {
-			LOGGING_FUNC("Received signed request but couldn't get peer key")
+			n.replyWithError(receivedMsg, "signed request but we couldn't get your public key")
 			return
 		}
 	}
 
-	if len(peerPublicKey) == KEY_SIZE && receivedMsg.Msg.Signature == nil && slices.Contains(MANDATORILY_SIGNED_MSGS, receivedMsg.Msg.Type) {
-		LOGGING_FUNC("Peer that implements cryptography sent an unsigned request of a type that must be signed")
+	if len(peerPublicKey) == KEY_SIZE && receivedMsg.Msg.Signature == nil && receivedMsg.SealedBy == "" && slices.Contains(MANDATORILY_SIGNED_MSGS, receivedMsg.Msg.Type) {
+		t, _ := byteToMsgTypeAsStr(receivedMsg.Msg.Type)
+		n.replyWithError(receivedMsg, "unsigned "+t+" but you have a public key, "+t+" must be signed")
 		return
 	}
 
+	// A signed request can be captured and replayed, the ones already received are not handled again
+	// The peer may also have reemitted it because our reply was lost, so our reply is resent
+	replaySource := peerName
+	if replaySource == "" {
+		replaySource = receivedMsg.Addr.String()
+	}
+	if receivedMsg.Msg.Signature != nil || receivedMsg.SealedBy != "" {
+		seen, previousReply := replayCheckRequest(replaySource, receivedMsg.Msg.Id)
+		if seen {
+			LOGGING_FUNC("Signed request with ID", receivedMsg.Msg.Id, "already received from", replaySource)
+			if previousReply != nil {
+				replayedRequestsAnsweredCount.Add(1)
+				n.simpleSendMsgToAddr(receivedMsg.Addr, *previousReply)
+			}
+			return
+		}
+	}
+
 	var replyMsg udpMsg
 	switch receivedMsg.Msg.Type {
 	case NOOP:
 		return
+	case ERROR:
+		n.peerErrorsRecord(receivedMsg.Addr, ERROR, string(receivedMsg.Msg.Body))
+		peerErrorsPrint(fmt.Sprintf("Error from %s: %s", n.peerNameOrAddr(receivedMsg.Addr), string(receivedMsg.Msg.Body)))
+		// An empty ErrorReply acknowledges the Error
+		replyMsg = createMsgWithId(receivedMsg.Msg.Id, ERROR_REPLY, []byte{})
 	case HELLO:
-		replyMsg, _ = createComplexHello(receivedMsg.Msg.Id, HELLO_REPLY)
 		parsedHello, _ := parseHello(receivedMsg.Msg.Body)
-		peersAddAddr(parsedHello.PeerName, receivedMsg.Addr)
+		if mainPeerOn {
+			err = mainPeerCheckHello(parsedHello.PeerName)
+			if err != nil {
+				n.replyWithError(receivedMsg, err.Error())
+				return
+			}
+		}
+		replyMsg, _ = createComplexHello(n.Name, receivedMsg.Msg.Id, HELLO_REPLY)
+		n.peersAddAddr(parsedHello.PeerName, receivedMsg.Addr)
+		peerExtensionsSet(parsedHello.PeerName, parsedHello.Extensions)
 	case PUBLIC_KEY:
 		replyMsg = createMsgWithId(receivedMsg.Msg.Id, PUBLIC_KEY_REPLY, publicKeyToHexaString())
 	case ROOT:
-		replyMsg = createMsgWithId(receivedMsg.Msg.Id, ROOT_REPLY, ourTree.Hash)
+		tree, _ := ourTreeGet()
+		if tree == nil {
+			n.replyWithError(receivedMsg, OUR_TREE_NOT_READY)
+			return
+		}
+		replyMsg = createMsgWithId(receivedMsg.Msg.Id, ROOT_REPLY, tree.Hash)
 	case GET_DATUM:
-		value, found := ourTreeMap[string(receivedMsg.Msg.Body)]
+		_, treeMap := ourTreeGet()
+		if treeMap == nil {
+			n.replyWithError(receivedMsg, OUR_TREE_NOT_READY)
+			return
+		}
+		value, found := treeMap[string(receivedMsg.Msg.Body)]
 		if found {
 			replyMsg, err = value.toDatum(receivedMsg.Msg.Id)
 			if err != nil {
 				LOGGING_FUNC(err)
+				n.replyWithError(receivedMsg, "couldn't read datum")
 				return
 			}
 		} else {
 			replyMsg = createMsgWithId(receivedMsg.Msg.Id, NO_DATUM, receivedMsg.Msg.Body)
 		}
 	case NAT_TRAVERSAL:
-		if receivedMsg.Msg.Length != IPV4_SIZE+PORT_SIZE { // TODO IPv6
-			LOGGING_FUNC("Received a NAT traversal request with an IPv6, ignoring")
+		// The body size was checked by checkMsgIntegrity
+		peerAddr, _ := byteSliceToUDPAddr(receivedMsg.Msg.Body)
+		if !n.udpAddrIsReachable(peerAddr) {
+			LOGGING_FUNC("Received a NAT traversal for", peerAddr.String(), "but we have no socket of its family, ignoring")
 			return
 		}
-		peerAddr, _ := byteSliceToUDPAddr(receivedMsg.Msg.Body)
 
 		LOGGING_FUNC("NAT traversal started by peer", peerAddr.String())
 
-		var theirNatTraversalErr error
-		for i := 0; i < NAT_TRAVERSAL_RETRIES; i++ {
-			_, theirNatTraversalErr = sendToAddrAndReceiveMsgWithReemissions(peerAddr, createHello())
-			// A SOFT error is not tolerated
-			if theirNatTraversalErr == nil {
-				break
-			}
-		}
-		if theirNatTraversalErr == nil {
-			LOGGING_FUNC("Received HelloReply from peer", peerAddr.String(), "after they started a NAT traversal")
-		} else {
-			LOGGING_FUNC("NAT traversal started by", peerAddr.String(), "failed")
+		// Runs in the background so that the worker is not blocked during the traversal
+		n.natTraversalStartedByPeer(peerAddr)
+		return
+	case NAT_TRAVERSAL_REQUEST:
+		if !mainPeerOn {
+			n.replyWithError(receivedMsg, "we are not the main peer, send NatTraversalRequest to "+SERVER_PEER_NAME)
+			return
 		}
+		n.mainPeerRelayNatTraversal(receivedMsg, peerName)
 		return
 	default:
 		LOGGING_FUNC("received request that we don't handle: " + udpMsgToString(receivedMsg.Msg))
+		if errorReplyIsAllowed(receivedMsg.Addr) {
+			t, _ := byteToMsgTypeAsStr(receivedMsg.Msg.Type)
+			n.replyWithError(receivedMsg, fmt.Sprintf("unsupported request type %s (%d)", t, receivedMsg.Msg.Type))
+		}
 		return
 	}
 
@@ -290,76 +481,169 @@ func handleMsg(receivedMsg addrUdpMsg) {
 		fmt.Printf("From %s: received ID %d, sent ID %d, received type %s, sent type %s\n", receivedMsg.Addr.String(), receivedMsg.Msg.Id, replyMsg.Id, t, t2)
 	}
 
+	if receivedMsg.SealedBy != "" {
+		replyMsg, err = sealMsg(receivedMsg.SealedBy, replyMsg, SEALED_REPLY)
+		if err != nil {
+			LOGGING_FUNC("Couldn't seal reply:", err)
+			return
+		}
+	}
+
+	if receivedMsg.Msg.Signature != nil || receivedMsg.SealedBy != "" {
+		replayRecordReply(replaySource, receivedMsg.Msg.Id, replyMsg)
+	}
+
 	// Note that we reply to peers even if they have never sent Hello
-	simpleSendMsgToAddr(receivedMsg.Addr, replyMsg)
+	n.simpleSendMsgToAddr(receivedMsg.Addr, replyMsg)
 }
 
-func listenAndRespond() {
-	for {
-		addrMsg, err := receiveAnyMsg()
+// Replies to a request that we refuse with an ErrorReply telling why
+// The ErrorReply is sealed if the request was, a cleartext one tells the peer to stop sealing
+func (n *udpNode) replyWithError(receivedMsg addrUdpMsg, reason string) {
+	LOGGING_FUNC("Sending ErrorReply to", receivedMsg.Addr.String()+":", reason)
+	errorReply := createErrorReply(receivedMsg.Msg.Id, reason)
+	if receivedMsg.SealedBy != "" {
+		sealed, err := sealMsg(receivedMsg.SealedBy, errorReply, SEALED_REPLY)
 		if err == nil {
-			go handleMsg(addrMsg)
-		} else {
-			LOGGING_FUNC(err)
+			errorReply = sealed
 		}
 	}
+	n.simpleSendMsgToAddr(receivedMsg.Addr, errorReply)
 }
 
-func retrieveInMsgQueue(sentMsg addrUdpMsg) (addrUdpMsg, error) {
-	var foundMsg *list.Element
+func (n *udpNode) listenAndRespond() {
+	for i := 0; i < NB_REQUEST_WORKERS; i++ {
+		go n.requestWorker()
+	}
 
-	startTime := time.Now()
+	n.transport.Serve(n.receivePacket)
+}
 
-	for time.Since(startTime) < MSG_QUEUE_MAX_WAIT {
-		msgQueueMutex.RLock()
-		for m := msgQueue.Front(); m != nil; m = m.Next() {
-			mCasted := m.Value.(addrUdpMsg)
-			if compareUDPAddr(mCasted.Addr, sentMsg.Addr) && mCasted.Msg.Id == sentMsg.Msg.Id {
-				foundMsg = m
-				break
-			}
-		}
-		msgQueueMutex.RUnlock()
-		if foundMsg != nil {
-			break
+func (n *udpNode) requestWorker() {
+	for receivedMsg := range n.requestQueue {
+		n.handleMsg(receivedMsg)
+	}
+}
+
+// Registers toSend as a request in flight to peerAddr
+// If another request in flight to peerAddr already uses the ID of toSend, the message is recreated with a free ID
+// Returns the message to actually send and the channel in which the reply will be delivered
+func (n *udpNode) pendingRequestsRegister(peerAddr *net.UDPAddr, toSend udpMsg) (udpMsg, chan addrUdpMsg) {
+	n.pendingRequestsMutex.Lock()
+	defer n.pendingRequestsMutex.Unlock()
+
+	key := pendingRequestKey{peerAddr.String(), toSend.Id}
+	_, found := n.pendingRequests[key]
+	if found {
+		for found {
+			key.Id = rand.Uint32()
+			_, found = n.pendingRequests[key]
 		}
+		LOGGING_FUNC_F("ID %d already in flight to %s, using ID %d\n", toSend.Id, peerAddr.String(), key.Id)
+		toSend = createMsgWithId(key.Id, toSend.Type, toSend.Body)
 	}
 
-	if foundMsg != nil {
-		msgQueueMutex.Lock()
-		msgQueue.Remove(foundMsg)
-		msgQueueMutex.Unlock()
+	// Buffered so that handleMsg never blocks on a sender that is about to give up
+	replyChan := make(chan addrUdpMsg, 1)
+	n.pendingRequests[key] = replyChan
+
+	return toSend, replyChan
+}
+
+func (n *udpNode) pendingRequestsUnregister(peerAddr *net.UDPAddr, id uint32) {
+	n.pendingRequestsMutex.Lock()
+	defer n.pendingRequestsMutex.Unlock()
+
+	delete(n.pendingRequests, pendingRequestKey{peerAddr.String(), id})
+}
+
+// Gives a reply to the request waiting for it
+// Returns false if no request in flight matches the reply
+func (n *udpNode) pendingRequestsDeliver(reply addrUdpMsg) bool {
+	n.pendingRequestsMutex.Lock()
+	defer n.pendingRequestsMutex.Unlock()
+
+	replyChan, found := n.pendingRequests[pendingRequestKey{reply.Addr.String(), reply.Msg.Id}]
+	if !found {
+		return false
+	}
 
-		return foundMsg.Value.(addrUdpMsg), nil
+	select {
+	case replyChan <- reply:
+	default: // A reply to a previous emission of the same request was already delivered
+		LOGGING_FUNC("Dropping duplicate reply from", reply.Addr.String(), "with ID", reply.Msg.Id)
 	}
-	return addrUdpMsg{}, fmt.Errorf("msg not found in msg queue")
+
+	return true
+}
+
+func (n *udpNode) pendingRequestsCount() int {
+	n.pendingRequestsMutex.Lock()
+	defer n.pendingRequestsMutex.Unlock()
+
+	return len(n.pendingRequests)
 }
 
 // TODO Check that we don't send replies or requests without a reply e.g. NoOp (verify toSend.Type)
-// This is not supposed to modify peers
+// This is not supposed to modify n.peers
 // This function has errors that start by "SOFT ", they mean that a reply was received but it was invalid. If an error is not "SOFT ", assume that a reply was not received.
-func sendToAddrAndReceiveMsgWithReemissions(peerAddr *net.UDPAddr, toSend udpMsg) (udpMsg, error) {
-	var retrieveErr error
+func (n *udpNode) sendToAddrAndReceiveMsgWithReemissions(peerAddr *net.UDPAddr, toSend udpMsg) (udpMsg, error) {
+	return n.sendToAddrAndReceiveMsgWithReemissionsOrCancel(peerAddr, toSend, nil)
+}
+
+// Like sendToAddrAndReceiveMsgWithReemissions but gives up as soon as cancel is closed, cancel may be nil
+func (n *udpNode) sendToAddrAndReceiveMsgWithReemissionsOrCancel(peerAddr *net.UDPAddr, toSend udpMsg, cancel <-chan struct{}) (udpMsg, error) {
+	toSend, replyChan := n.pendingRequestsRegister(peerAddr, toSend)
+	defer n.pendingRequestsUnregister(peerAddr, toSend.Id)
+
+	// The Sealed has the Id of toSend so its reply matches the pending request
+	wireMsg := toSend
+	sealPeerName := n.peersGetKeyFromVal(peerAddr)
+	if sealedSessionShouldSeal(sealPeerName, toSend.Type) {
+		sealed, err := sealMsg(sealPeerName, toSend, SEALED)
+		if err != nil {
+			LOGGING_FUNC("Couldn't seal request, sending it in cleartext:", err)
+		} else {
+			wireMsg = sealed
+		}
+	}
+
 	var replyMsg addrUdpMsg
-	for i := 0; i < NUMBER_OF_REEMISSIONS+1; i++ {
+	replyReceived := false
+	rto := rttGetRto(peerAddr)
+	for i := 0; i < NUMBER_OF_REEMISSIONS+1 && !replyReceived; i++ {
 		if i != 0 {
-			LOGGING_FUNC_F("Reemission %d of ID %d\n", i, toSend.Id)
+			rto = clampRto(2 * rto) // Exponential backoff
+			LOGGING_FUNC_F("Reemission %d of ID %d with RTO %v\n", i, toSend.Id, rto)
 		}
 
-		err := simpleSendMsgToAddr(peerAddr, toSend)
+		err := n.simpleSendMsgToAddr(peerAddr, wireMsg)
 		if err != nil {
 			return udpMsg{}, err
 		}
-
-		// The ID match check is here
-		replyMsg, retrieveErr = retrieveInMsgQueue(addrUdpMsg{peerAddr, toSend})
-		if retrieveErr == nil {
-			break
+		sendTime := time.Now()
+
+		// The ID match check is done by pendingRequestsDeliver
+		timer := time.NewTimer(rto)
+		select {
+		case replyMsg = <-replyChan:
+			replyReceived = true
+			// Karn's rule: a reply to a reemitted request may answer any of the emissions, so it is not a valid sample
+			if i == 0 {
+				rttAddSample(peerAddr, time.Since(sendTime))
+				congestionWindowOnReply(sealPeerName)
+			}
+		case <-timer.C:
+			congestionWindowOnLoss(sealPeerName, peerAddr)
+		case <-cancel:
+			timer.Stop()
+			return udpMsg{}, fmt.Errorf("request to %s cancelled", peerAddr.String())
 		}
+		timer.Stop()
 	}
 
-	if retrieveErr != nil {
-		return udpMsg{}, retrieveErr
+	if !replyReceived {
+		return udpMsg{}, fmt.Errorf("no reply from %s to ID %d", peerAddr.String(), toSend.Id)
 	}
 
 	if DEBUG {
@@ -368,8 +652,36 @@ func sendToAddrAndReceiveMsgWithReemissions(peerAddr *net.UDPAddr, toSend udpMsg
 		fmt.Printf("To %s: sent ID %d, received ID %d, sent type %s, received type %s\n", peerAddr.String(), toSend.Id, replyMsg.Msg.Id, t, t2)
 	}
 
-	if replyMsg.Msg.Type == ERROR_REPLY {
-		fmt.Fprintln(os.Stderr, udpMsgToString(replyMsg.Msg))
+	if wireMsg.Type == SEALED {
+		switch replyMsg.Msg.Type {
+		case SEALED_REPLY:
+			inner, err := unsealMsg(sealPeerName, replyMsg.Msg)
+			if err != nil {
+				return udpMsg{}, fmt.Errorf("SOFT " + err.Error())
+			}
+			replyMsg.Msg = inner
+			replyMsg.SealedBy = sealPeerName
+		case ERROR_REPLY:
+			// A cleartext ErrorReply means that the peer couldn't unseal e.g. it doesn't have our key
+			// Anybody who sees the Sealed could send one to make us send cleartext, so the peer must have signed it
+			if !n.replyIsSignedByPeer(replyMsg) {
+				return udpMsg{}, fmt.Errorf("SOFT unauthenticated cleartext ErrorReply to a Sealed: %s", string(replyMsg.Msg.Body))
+			}
+			LOGGING_FUNC("Cleartext ErrorReply to a Sealed from", sealPeerName+":", string(replyMsg.Msg.Body))
+			sealedSessionDisable(sealPeerName)
+			return n.sendToAddrAndReceiveMsgWithReemissionsOrCancel(peerAddr, toSend, cancel)
+		}
+	}
+
+	if replyMsg.Msg.Type == ERROR_REPLY && toSend.Type != ERROR {
+		// Anybody who sees our request can answer it with an ErrorReply, only the ones from the peer are recorded
+		if replyMsg.SealedBy != "" || n.replyIsSignedByPeer(replyMsg) {
+			n.peerErrorsRecord(peerAddr, ERROR_REPLY, string(replyMsg.Msg.Body))
+			peerErrorsPrint(fmt.Sprintf("ErrorReply from %s: %s", n.peerNameOrAddr(peerAddr), string(replyMsg.Msg.Body)))
+		} else {
+			LOGGING_FUNC("Unauthenticated ErrorReply from", peerAddr.String()+":", string(replyMsg.Msg.Body))
+		}
+		return udpMsg{}, fmt.Errorf("SOFT peer replied with an error: %s", string(replyMsg.Msg.Body))
 	}
 
 	/* else if replyMsg.Msg.Type == HELLO_REPLY {
@@ -393,7 +705,6 @@ func sendToAddrAndReceiveMsgWithReemissions(peerAddr *net.UDPAddr, toSend udpMsg
 		return udpMsg{}, fmt.Errorf("SOFT " + err.Error())
 	}
 
-	// TODO Reemit if ErrorReply?
 	if !checkMsgTypePair(toSend.Type, replyMsg.Msg.Type) {
 		return udpMsg{}, fmt.Errorf("SOFT reply doesn't match type of pair: " + udpMsgToString(replyMsg.Msg))
 	}
@@ -403,20 +714,12 @@ func sendToAddrAndReceiveMsgWithReemissions(peerAddr *net.UDPAddr, toSend udpMsg
 		hello, _ := parseHello(replyMsg.Msg.Body)
 		peerName = hello.PeerName
 	} else {
-		peerName = peersGetKeyFromVal(replyMsg.Addr)
+		peerName = n.peersGetKeyFromVal(replyMsg.Addr)
 	}
 
 	peerPublicKey := []byte{}
 	if peerName != "" {
-		peerKeysMutex.Lock()
-		v, f := peerKeys[peerName]
-		if f {
-			peerPublicKey = v
-		} else {
-			peerPublicKey = restGetKey(peerName)
-			peerKeys[peerName] = peerPublicKey
-		}
-		peerKeysMutex.Unlock()
+		peerPublicKey = peerKeysGet(peerName)
 	}
 
 	if replyMsg.Msg.Signature != nil {
@@ -425,26 +728,47 @@ func sendToAddrAndReceiveMsgWithReemissions(peerAddr *net.UDPAddr, toSend udpMsg
 				return udpMsg{}, fmt.Errorf("bad signature in received reply")
 			} else {
 				LOGGING_FUNC("Successfully verified signature of reply message")
+				if replyMsg.Msg.Type == HELLO_REPLY {
+					n.livenessOnVerifiedHello(replyMsg.Addr, peerName)
+				}
 			}
 		} else {
 			return udpMsg{}, fmt.Errorf("received signed reply but couldn't get peer key")
 		}
 	}
 
-	if len(peerPublicKey) == KEY_SIZE && replyMsg.Msg.Signature == nil && slices.Contains(MANDATORILY_SIGNED_MSGS, replyMsg.Msg.Type) {
+	if len(peerPublicKey) == KEY_SIZE && replyMsg.Msg.Signature == nil && replyMsg.SealedBy == "" && slices.Contains(MANDATORILY_SIGNED_MSGS, replyMsg.Msg.Type) {
 		return udpMsg{}, fmt.Errorf("peer that implements cryptography sent an unsigned reply of a type that must be signed")
 	}
 
+	if replyMsg.Msg.Type == HELLO_REPLY {
+		parsedHello, _ := parseHello(replyMsg.Msg.Body)
+		peerExtensionsSet(parsedHello.PeerName, parsedHello.Extensions)
+	}
+
 	return replyMsg.Msg, nil
 }
 
+// Returns true if reply has a valid signature of the peer that has its address
+func (n *udpNode) replyIsSignedByPeer(reply addrUdpMsg) bool {
+	if reply.Msg.Signature == nil {
+		return false
+	}
+	peerName := n.peersGetKeyFromVal(reply.Addr)
+	if peerName == "" {
+		return false
+	}
+	peerPublicKey := peerKeysGet(peerName)
+	return len(peerPublicKey) == KEY_SIZE && checkMsgSignature(reply.Msg, peerPublicKey)
+}
+
 // Must not stop e.g. internet connection stops and comes back 10 minutes after...
 // Keeps alive existing server addresses and new addresses obtained from REST
-// This maintains SERVER_PEER_NAME in peers, no other function should modify key SERVER_PEER_NAME in peers
-func keepAliveMainPeer() {
+// This maintains SERVER_PEER_NAME in peers, no other function should modify key SERVER_PEER_NAME in n.peers
+func (n *udpNode) keepAliveMainPeer() {
 	for {
 		restMainPeerAddresses, err := restGetAddressesOfPeer(SERVER_PEER_NAME, false)
-		currentMainPeerAddresses, found := peersGet(SERVER_PEER_NAME)
+		currentMainPeerAddresses, found := n.peersGet(SERVER_PEER_NAME)
 
 		allMainPeerAddresses := []*net.UDPAddr{}
 		if err == nil {
@@ -454,42 +778,27 @@ func keepAliveMainPeer() {
 			allMainPeerAddresses = appendAddressesIfNotPresent(allMainPeerAddresses, currentMainPeerAddresses)
 		}
 
+		nbIPv4Replies := 0
 		for _, a := range allMainPeerAddresses {
-			if a.IP.To4() != nil { // If it is a v4 IP
-				_, err := sendToAddrAndReceiveMsgWithReemissions(a, createHello())
+			if n.udpAddrIsReachable(a) {
+				_, err := n.sendToAddrAndReceiveMsgWithReemissions(a, createHello(n.Name))
 				if err != nil {
-					peersRemoveAddr(SERVER_PEER_NAME, a)
+					n.peersRemoveAddr(SERVER_PEER_NAME, a)
 					LOGGING_FUNC("Main peer doesn't reply or replies incorrectly: ", err)
 				} else {
-					peersAddAddr(SERVER_PEER_NAME, a)
+					n.peersAddAddr(SERVER_PEER_NAME, a)
+					if a.IP.To4() != nil {
+						nbIPv4Replies++
+					}
 				}
 			}
 		}
 
-		time.Sleep(KEEP_ALIVE_PERIOD)
-	}
-}
-
-func natTraversal(addr *net.UDPAddr) error {
-	LOGGING_FUNC("Starting NAT traversal with peer", addr.String())
-
-	natTraversalRequest := createNatTraversalRequestMsg(addr)
+		// The REST server knows the addresses from which the main peer received our Hellos
+		n.updateOurObservedAddrs(nbIPv4Replies)
 
-	mainPeerAddresses, found := peersGet(SERVER_PEER_NAME)
-	if !found {
-		return fmt.Errorf("no connection with main peer found during our NAT traversal")
-	}
-
-	var err2 error
-	for i := 0; i < NAT_TRAVERSAL_RETRIES; i++ {
-		simpleSendMsgToAddr(mainPeerAddresses[0], natTraversalRequest)
-		_, err2 = sendToAddrAndReceiveMsgWithReemissions(addr, createHello())
-		if err2 == nil {
-			return nil
-		}
+		time.Sleep(KEEP_ALIVE_PERIOD)
 	}
-
-	return fmt.Errorf("our NAT traversal failed (%s)", err2.Error())
 }
 
 ////////////////////////////////////////////////// Below is API used by other files
@@ -497,68 +806,30 @@ func natTraversal(addr *net.UDPAddr) error {
 // Can safely be used for SERVER_PEER_NAME or OUR_PEER_NAME (they should already be in peers, and anyways sending more Hellos is OK)
 // TODO Check that we send a request that requires a reply
 // Returns an error starting by "SOFT " if a reply was received but it was invalid e.g. NoDatum
-func ConnectAndSendAndReceive(peerName string, toSend udpMsg) (udpMsg, error) {
-	addressesInPeers, found := peersGet(peerName)
-
-	// If it is in peers we have already sent Hello before, first try to send toSend to the addresses already in peers
-
-	if found {
-		addressesInPeersCopy := []*net.UDPAddr{}
-		addressesInPeersCopy = append(addressesInPeersCopy, addressesInPeers...)
-
-		for _, a := range addressesInPeersCopy {
-			replyMsg, err := sendToAddrAndReceiveMsgWithReemissions(a, toSend)
-			if err != nil && !grep("^SOFT ", err.Error()) {
-				LOGGING_FUNC("Removing address", a, "from peers because of HARD error", err)
-				peersRemoveAddr(peerName, a)
-			} else if err != nil && grep("^SOFT ", err.Error()) {
-				LOGGING_FUNC("SOFT error, not removing address from peers:", err)
-				return replyMsg, err
-			} else {
-				return replyMsg, nil
-			}
+func (n *udpNode) ConnectAndSendAndReceive(peerName string, toSend udpMsg) (udpMsg, error) {
+	// The address that won the last race is used until it fails
+	a := n.peerPreferredAddrGet(peerName)
+	if a != nil {
+		replyMsg, err := n.sendToAddrAndReceiveMsgWithReemissions(a, toSend)
+		if err == nil || grep("^SOFT ", err.Error()) {
+			return replyMsg, err
 		}
+		LOGGING_FUNC("Removing address", a, "from peers because of HARD error", err)
+		n.peersRemoveAddr(peerName, a)
+		n.peerPreferredAddrForget(peerName, a)
 	}
 
-	restPeerAddresses, err := restGetAddressesOfPeer(peerName, false)
+	a, err := n.connectToPeer(peerName)
 	if err != nil {
 		return udpMsg{}, err
 	}
 
-	for _, a := range restPeerAddresses {
-		if a.IP.To4() != nil {
-			_, helloWithoutNatErr := sendToAddrAndReceiveMsgWithReemissions(a, createHello())
-
-			var natTraversalErr error
-			if helloWithoutNatErr != nil {
-				natTraversalErr = natTraversal(a)
-				if natTraversalErr == nil {
-					LOGGING_FUNC("NAT traversal started by us succeeded for", a.String())
-				} else {
-					LOGGING_FUNC("NAT traversal started by us failed for", a.String())
-				}
-			}
-
-			if helloWithoutNatErr == nil || natTraversalErr == nil {
-				replyMsg, err := sendToAddrAndReceiveMsgWithReemissions(a, toSend)
-				// If HARD error do nothing
-				if err != nil && grep("^SOFT ", err.Error()) {
-					peersAddAddr(peerName, a)
-					return replyMsg, err
-				} else if err == nil {
-					peersAddAddr(peerName, a)
-					return replyMsg, nil
-				}
-			}
-		}
-	}
-
-	return udpMsg{}, fmt.Errorf("can't resolve or communicate with peer %s", peerName)
+	return n.sendToAddrAndReceiveMsgWithReemissions(a, toSend)
 }
 
 func DownloadDatum(peerName string, hash []byte) (byte, interface{}, error) {
 	getDatumMsg := createMsg(GET_DATUM, hash)
-	datumReply, err := ConnectAndSendAndReceive(peerName, getDatumMsg)
+	datumReply, err := ourNode.ConnectAndSendAndReceive(peerName, getDatumMsg)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -568,8 +839,8 @@ func DownloadDatum(peerName string, hash []byte) (byte, interface{}, error) {
 
 // TODO Return error if hash of empty string
 func GetRootOfPeerUDPThenREST(peerName string) ([]byte, error) {
-	rootMsg := createMsg(ROOT, ourTree.Hash)
-	rootReplyMsg, err := ConnectAndSendAndReceive(peerName, rootMsg)
+	rootMsg := createMsg(ROOT, ourRootHash())
+	rootReplyMsg, err := ourNode.ConnectAndSendAndReceive(peerName, rootMsg)
 	if err != nil {
 		LOGGING_FUNC(err)
 		return restGetRootOfPeer(peerName)
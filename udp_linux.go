@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// struct mmsghdr of recvmmsg(2), Go adds the same trailing padding as C
+type mmsghdr struct {
+	Hdr syscall.Msghdr
+	Len uint32
+}
+
+// Binds a single socket to addr and returns it with duplicates of its descriptor, one per CPU (at most MAX_SOCKETS_PER_FAMILY)
+// Each duplicate has its own reader, they all share the receive queue of the socket
+// A datagram wakes every reader blocked on the socket, the ones that find the queue empty wait again, a busy reader leaves the queue to the others
+// SO_REUSEPORT is not used as any process of our user could then bind the port too and get some of our datagrams
+func listenUdpSockets(network string, addr *net.UDPAddr) ([]*net.UDPConn, error) {
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conns := []*net.UDPConn{conn}
+	for len(conns) < min(runtime.NumCPU(), MAX_SOCKETS_PER_FAMILY) {
+		duplicate, err := duplicateUdpConn(conn)
+		if err != nil {
+			LOGGING_FUNC("Reading with only", len(conns), "descriptors:", err)
+			break
+		}
+		conns = append(conns, duplicate)
+	}
+
+	return conns, nil
+}
+
+// Returns a conn reading the same socket as conn with another descriptor
+func duplicateUdpConn(conn *net.UDPConn) (*net.UDPConn, error) {
+	file, err := conn.File()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // FilePacketConn has its own duplicate
+
+	packetConn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	duplicate, ok := packetConn.(*net.UDPConn)
+	if !ok {
+		packetConn.Close()
+		return nil, fmt.Errorf("duplicate of %s is not a UDP socket", conn.LocalAddr().String())
+	}
+	return duplicate, nil
+}
+
+func rawSockaddrToUDPAddr(rsa *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port)) // Network byte order
+		return &net.UDPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: int(port[0])<<8 | int(port[1])}
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return &net.UDPAddr{IP: net.IP(append([]byte{}, sa.Addr[:]...)), Port: int(port[0])<<8 | int(port[1])}
+	}
+	return nil
+}
+
+// Reads up to RECEIVE_BATCH_SIZE datagrams per recvmmsg(2) into buffers reused for the whole life of the socket
+func receiveLoop(conn *net.UDPConn, deliver func(packet []byte, addr *net.UDPAddr)) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		LOGGING_FUNC(err)
+		receiveLoopOneByOne(conn, deliver)
+		return
+	}
+
+	buffers := make([][]byte, RECEIVE_BATCH_SIZE)
+	names := make([]syscall.RawSockaddrAny, RECEIVE_BATCH_SIZE)
+	iovecs := make([]syscall.Iovec, RECEIVE_BATCH_SIZE)
+	msgs := make([]mmsghdr, RECEIVE_BATCH_SIZE)
+	for i := range msgs {
+		buffers[i] = make([]byte, UDP_BUFFER_SIZE)
+		iovecs[i].Base = &buffers[i][0]
+		iovecs[i].SetLen(UDP_BUFFER_SIZE)
+		msgs[i].Hdr.Iov = &iovecs[i]
+		msgs[i].Hdr.Iovlen = 1
+		msgs[i].Hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+	}
+
+	for {
+		nbReceived := 0
+		var errno syscall.Errno
+
+		// The callback returns false to wait with the runtime poller until the socket is readable
+		err := rawConn.Read(func(fd uintptr) bool {
+			for i := range msgs {
+				msgs[i].Hdr.Namelen = syscall.SizeofSockaddrAny
+			}
+			r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), syscall.MSG_DONTWAIT, 0, 0)
+			if e == syscall.EAGAIN {
+				return false
+			}
+			nbReceived = int(r)
+			errno = e
+			return true
+		})
+		if err != nil { // The socket was closed
+			LOGGING_FUNC(err)
+			return
+		}
+		if errno != 0 {
+			LOGGING_FUNC("recvmmsg:", errno)
+			continue
+		}
+
+		for i := 0; i < nbReceived; i++ {
+			// UDP_BUFFER_SIZE is the size of the biggest valid message, so a truncated datagram is invalid
+			if msgs[i].Hdr.Flags&syscall.MSG_TRUNC != 0 {
+				LOGGING_FUNC("Dropping datagram of more than", UDP_BUFFER_SIZE, "bytes")
+				continue
+			}
+			peerAddr := rawSockaddrToUDPAddr(&names[i])
+			if peerAddr != nil {
+				deliver(buffers[i][:msgs[i].Len], peerAddr)
+			}
+		}
+	}
+}
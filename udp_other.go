@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+)
+
+// Binds a single socket with a single reader, duplicated descriptors and recvmmsg are only used on Linux
+func listenUdpSockets(network string, addr *net.UDPAddr) ([]*net.UDPConn, error) {
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return []*net.UDPConn{conn}, nil
+}
+
+func receiveLoop(conn *net.UDPConn, deliver func(packet []byte, addr *net.UDPAddr)) {
+	receiveLoopOneByOne(conn, deliver)
+}
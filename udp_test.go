@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Runs the test from DIR/PSI-download with files shared in DIR/PSI-shared-files, like main does
+func chdirToTestRun(t *testing.T, sharedFiles map[string][]byte) {
+	dir := t.TempDir()
+	for name, contents := range sharedFiles {
+		path := filepath.Join(dir, "PSI-shared-files", name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.WriteFile(path, contents, 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Mkdir(filepath.Join(dir, DOWNLOAD_DIR), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(filepath.Join(dir, DOWNLOAD_DIR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previousDir) })
+}
+
+// Generates our key, the nodes of a test share it as they share peerKeys
+func setTestKeys(t *testing.T) {
+	var err error
+	privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey = &privateKey.PublicKey
+}
+
+// Downloads the file or directory with hash from addr and returns the contents of its files by path
+func downloadFromNode(t *testing.T, n *udpNode, addr *net.UDPAddr, hash []byte, path string, files map[string][]byte) {
+	reply, err := n.sendToAddrAndReceiveMsgWithReemissions(addr, createMsg(GET_DATUM, hash))
+	if err != nil {
+		t.Fatalf("GetDatum of %s: %v", path, err)
+	}
+	datumType, datum, err := parseDatum(reply.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch datumType {
+	case CHUNK:
+		files[path] = append(files[path], datum.(datumChunk).Contents...)
+	case TREE:
+		for _, h := range datum.(datumTree).ChildrenHashes {
+			downloadFromNode(t, n, addr, h, path, files)
+		}
+	case DIRECTORY:
+		for name, h := range datum.(datumDirectory).Children {
+			downloadFromNode(t, n, addr, h, joinTreePath(path, name), files)
+		}
+	}
+}
+
+// Two nodes in the process exchange Hello, Root and GetDatum over an in-memory network that drops datagrams
+// The network is seeded and the exchanges are sequential, so the same datagrams are dropped at each run
+func TestTwoNodesWithLoss(t *testing.T) {
+	shared := map[string][]byte{
+		"small":       []byte("hello"),
+		"dir/big":     bytes.Repeat([]byte("0123456789"), 700),
+		"dir/empty":   {},
+		"dir/exactly": bytes.Repeat([]byte{1}, CHUNK_MAX_SIZE),
+	}
+	chdirToTestRun(t, shared)
+	setTestKeys(t)
+
+	network := newMemNetwork(1)
+	network.LossRate = 0.1
+	addrA := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001}
+	addrB := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9002}
+	transportA, err := network.newTransport(addrA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transportB, err := network.newTransport(addrB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transportA.Close()
+	defer transportB.Close()
+
+	OUR_PEER_NAME = "A"
+	initUdpWithTransport(transportA)
+	a := ourNode
+	b := newUdpNode("B", transportB)
+	peerKeys[a.Name] = publicKeyToHexaString()
+	peerKeys[b.Name] = publicKeyToHexaString()
+
+	_, err = exportMerkleTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go a.listenAndRespond()
+	go b.listenAndRespond()
+
+	_, err = b.sendToAddrAndReceiveMsgWithReemissions(addrA, createHello(b.Name))
+	if err != nil {
+		t.Fatal("Hello:", err)
+	}
+	addresses, _ := a.peersGet(b.Name)
+	if !addrIsInSlice(addresses, addrB) {
+		t.Fatalf("A didn't register B from its Hello, A has %v", addresses)
+	}
+	b.peersAddAddr(a.Name, addrA)
+
+	rootReply, err := b.sendToAddrAndReceiveMsgWithReemissions(addrA, createMsg(ROOT, ourRootHash()))
+	if err != nil {
+		t.Fatal("Root:", err)
+	}
+	if !bytes.Equal(rootReply.Body, ourRootHash()) {
+		t.Fatalf("root %x, expected %x", rootReply.Body, ourRootHash())
+	}
+
+	files := make(map[string][]byte)
+	downloadFromNode(t, b, addrA, rootReply.Body, "", files)
+	if len(files) != len(shared) {
+		t.Fatalf("downloaded %d files, expected %d", len(files), len(shared))
+	}
+	for path, contents := range shared {
+		if !bytes.Equal(files[path], contents) {
+			t.Errorf("%s: downloaded %d bytes that differ from the %d shared", path, len(files[path]), len(contents))
+		}
+	}
+
+	if network.dropped() == 0 {
+		t.Error("no datagram was dropped, the reemissions weren't tested")
+	}
+}
@@ -39,7 +39,7 @@ func pathAutoComplete(line string) []string {
 
 	if grep("^[^/]+", splittedLine[1]) {
 		peerName := replaceAllRegexBy(splittedLine[1], "/.*", "")
-		_, found := peersGet(peerName)
+		_, found := ourNode.peersGet(peerName)
 		if found {
 			pathHashMap, err := getPeerPathHashMap(peerName)
 			if err == nil {
@@ -55,6 +55,14 @@ func pathAutoComplete(line string) []string {
 	return res
 }
 
+func printStats() {
+	fmt.Println("Requests waiting for a reply:", ourNode.pendingRequestsCount())
+	fmt.Println("Unsolicited replies dropped:", ourNode.unsolicitedRepliesCount.Load())
+	printCongestionWindows()
+	printRateLimitStats()
+	printReplayStats()
+}
+
 func mainMenu() error {
 	if helpMessage == "" {
 		helpMessage += "PATH is PEER_NAME[PATH2] with PATH2 = /videos for example\n"
@@ -118,27 +126,27 @@ func runLine(splittedLine []string) {
 
 	switch splittedLine[0] {
 	case "test":
-		m, err := ConnectAndSendAndReceive(OUR_OTHER_PEER_NAME, createHello())
+		m, err := ourNode.ConnectAndSendAndReceive(OUR_OTHER_PEER_NAME, createHello(ourNode.Name))
 		if err != nil {
 			LOGGING_FUNC(err)
 		} else {
 			fmt.Println("Received HelloReply from teammate:", udpMsgToString(m))
 		}
-		rootMsg := createMsg(ROOT, ourTree.Hash)
-		rootReply, err := ConnectAndSendAndReceive(OUR_OTHER_PEER_NAME, rootMsg)
+		rootMsg := createMsg(ROOT, ourRootHash())
+		rootReply, err := ourNode.ConnectAndSendAndReceive(OUR_OTHER_PEER_NAME, rootMsg)
 		checkErr(err)
 		if err == nil {
 			fmt.Println(udpMsgToString(rootReply))
 		}
 		getDatum := createMsg(GET_DATUM, rootReply.Body)
-		datum, err := ConnectAndSendAndReceive(OUR_OTHER_PEER_NAME, getDatum)
+		datum, err := ourNode.ConnectAndSendAndReceive(OUR_OTHER_PEER_NAME, getDatum)
 		checkErr(err)
 		if err == nil {
 			fmt.Println(udpMsgToString(datum))
 		}
 
 	case CMD_MAP["HELLO"].Name:
-		helloReply, err := ConnectAndSendAndReceive(splittedLine[1], createHello())
+		helloReply, err := ourNode.ConnectAndSendAndReceive(splittedLine[1], createHello(ourNode.Name))
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 		} else {
@@ -154,7 +162,13 @@ func runLine(splittedLine []string) {
 				fmt.Fprintln(os.Stderr, "Invalid argument")
 			}
 		} else {
-			restGetPeers(true)
+			peerNames, err := restGetPeers(false)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			for _, p := range peerNames {
+				fmt.Println(p + peerExtensionsDescription(p))
+			}
 		}
 	case CMD_MAP["LIST_FILES"].Name:
 		pathHashMap, err := getPeerPathHashMap(splittedLine[1])
@@ -178,6 +192,42 @@ func runLine(splittedLine []string) {
 		} else {
 			fmt.Fprintf(os.Stderr, "File %s not found\n", path)
 		}
+	case CMD_MAP["STATS"].Name:
+		printStats()
+	case CMD_MAP["LIVENESS"].Name:
+		ourNode.printLiveness()
+	case CMD_MAP["NAT"].Name:
+		ourNode.printNatState()
+	case CMD_MAP["RTT"].Name:
+		printRttEstimates()
+	case CMD_MAP["KEYS"].Name:
+		printKnownPeers()
+	case CMD_MAP["TRUST"].Name:
+		err := trustPeerKey(splittedLine[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	case CMD_MAP["FORGET"].Name:
+		err := forgetPeerKey(splittedLine[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	case CMD_MAP["SESSIONS"].Name:
+		printSealedSessions()
+	case CMD_MAP["SERVE_REST"].Name:
+		fmt.Fprintln(os.Stderr, "serve-rest makes us the main peer, run it from the command line e.g. go run . --port 8451 serve-rest :8080")
+	case CMD_MAP["TRACE"].Name:
+		if splittedLine[1] == "replay" {
+			fmt.Fprintln(os.Stderr, "A replay replaces the UDP layer, run it from the command line e.g. go run . trace replay FILE")
+		} else {
+			runTraceCommand(splittedLine[1:])
+		}
+	case CMD_MAP["ERRORS"].Name:
+		if len(splittedLine) == 2 {
+			printPeerErrors(splittedLine[1])
+		} else {
+			printPeerErrors("")
+		}
 	case "":
 		return
 	default: // Includes HELP
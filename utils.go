@@ -1,7 +1,7 @@
 package main
 
 import (
-	"container/list"
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
@@ -11,7 +11,6 @@ import (
 	"os"
 	"regexp"
 	"strings"
-	"sync"
 )
 
 // Wraps Mkdir func call
@@ -49,17 +48,6 @@ func writeChunk(path string, chunk []byte) error {
 	return nil
 }
 
-// Appends elem to list concurrency safe.
-// -list: the list in which to add
-// -mutex: to protect critical section
-// -elem: to be added
-func threadSafeAppendToList(list *list.List, mutex *sync.RWMutex, elem any) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	list.PushBack(elem)
-}
-
 // Compares to UDP addresses.
 // -first: the first address
 // -second: the second address
@@ -68,16 +56,44 @@ func compareUDPAddr(first *net.UDPAddr, second *net.UDPAddr) bool {
 	return first.String() == second.String()
 }
 
+var httpClient = &http.Client{Timeout: HTTP_TIMEOUT}
+
 // Wrapper of http.Get
 // - url: textual representation of the url to be visited
 // Returns: - the http Response
 //   - http repsonse body as byte slice
 //   - error if something goes wrong nil otherwise
 func httpGet(url string) (*http.Response, []byte, error) {
-	resp, err := http.Get(url)
+	resp, err := httpClient.Get(url)
 	if err != nil {
 		return nil, nil, err
 	}
+	defer resp.Body.Close()
+
+	bodyAsByteSlice, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, bodyAsByteSlice, nil
+}
+
+// header is added to the headers of the request, it may be nil
+func httpPut(url string, body []byte, header http.Header) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
 
 	bodyAsByteSlice, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -99,7 +115,7 @@ func removeTrailingSlash(path string) string {
 	return path
 }
 
-func getKeys(m map[string][]byte) []string {
+func getKeys[V any](m map[string]V) []string {
 	res := make([]string, 0)
 	for key := range m {
 		res = append(res, key)
@@ -126,30 +142,34 @@ func appendAddressesIfNotPresent(slice []*net.UDPAddr, addresses []*net.UDPAddr)
 	return slice
 }
 
+// Decodes a socket of a NatTraversal[Request]: IPv4 (4 bytes) or IPv6 (16 bytes) followed by the port
 // We assume that slice will never be modified after calling this
 func byteSliceToUDPAddr(slice []byte) (*net.UDPAddr, error) {
+	var ipSize int
 	if len(slice) == UDP_V4_SOCKET_SIZE {
-		port := binary.BigEndian.Uint16(slice[IPV4_SIZE:])
-		return &net.UDPAddr{IP: slice[:IPV4_SIZE], Port: int(port)}, nil
+		ipSize = IPV4_SIZE
 	} else if len(slice) == UDP_V6_SOCKET_SIZE {
-		panic("IPv6 not supported")
+		ipSize = IPV6_SIZE
 	} else {
-		return nil, fmt.Errorf("invalid slice length")
+		return nil, fmt.Errorf("%w: %d bytes, expected %d or %d", errAddrSize, len(slice), UDP_V4_SOCKET_SIZE, UDP_V6_SOCKET_SIZE)
 	}
+
+	port := binary.BigEndian.Uint16(slice[ipSize:])
+	return &net.UDPAddr{IP: slice[:ipSize], Port: int(port)}, nil
 }
 
+// Encodes addr on 6 bytes if it is an IPv4 (including IPv4-mapped IPv6) and on 18 bytes otherwise
 func udpAddrToByteSlice(addr *net.UDPAddr) []byte {
 	slice := []byte{}
 
 	var addrAsByteSlice []byte = addr.IP.To4()
-
 	if addrAsByteSlice == nil {
-		panic("IPv6 not supported")
+		addrAsByteSlice = addr.IP.To16()
 	}
 
 	slice = append(slice, addrAsByteSlice...)
 
-	var portAsByteSlice []byte = make([]byte, 2)
+	var portAsByteSlice []byte = make([]byte, PORT_SIZE)
 	binary.BigEndian.PutUint16(portAsByteSlice, uint16(addr.Port))
 
 	return append(slice, portAsByteSlice...)
@@ -165,18 +185,18 @@ func stringToZeroPaddedByteSlice(str string) []byte {
 // Removes the trailing zeroes from name.
 // - name: from which to remove \0s
 // - Returns: a valid string or error if data is not valid
-func zeroPaddedByteSliceToString(name []byte) string {
+// The name fills the slice if it has no NUL
+func zeroPaddedByteSliceToString(name []byte) (string, error) {
 	i := 0
-	for name[i] != 0 {
+	for i < len(name) && name[i] != 0 {
 		i++
 	}
 
 	if i == 0 {
-		LOGGING_FUNC("empty filenames are not allowed")
-		return ""
+		return "", fmt.Errorf("%w: empty filenames are not allowed", errInvalidFilename)
 	}
 
-	return string(name[:i])
+	return string(name[:i]), nil
 }
 
 func getHashOfByteSlice(slice []byte) []byte {
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Exports SHARED_FILES_DIR then re-exports it when its contents change so that peers get the new files without a restart
+// Watched with inotify on Linux, polled every SHARED_FILES_POLL_PERIOD otherwise or if inotify fails
+func watchSharedFiles() {
+	// Buffered so that a change during an export is not lost
+	changes := make(chan struct{}, 1)
+	// Receives the error that stopped the watcher, rewatch can't be used after it
+	failed := make(chan error, 1)
+
+	rewatch, err := startSharedFilesWatcher(SHARED_FILES_DIR, changes, failed)
+	if err != nil {
+		LOGGING_FUNC("Polling", SHARED_FILES_DIR, "every", SHARED_FILES_POLL_PERIOD, "instead of watching it:", err)
+		go pollSharedFiles(SHARED_FILES_DIR, changes)
+	}
+
+	// The first export runs here so that startup doesn't wait for the hashing, Root and GetDatum get an ErrorReply until it ends
+	// Retried after SHARED_FILES_SETTLE_DELAY until it succeeds, we share nothing until then
+	var retry <-chan time.Time
+	_, err = exportMerkleTree()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't export", SHARED_FILES_DIR+", we share nothing until it succeeds:", err)
+		retry = time.After(SHARED_FILES_SETTLE_DELAY)
+	} else {
+		tree, _ := ourTreeGet()
+		LOGGING_FUNC_F("Sharing %s, root %x\n", SHARED_FILES_DIR, tree.Hash)
+	}
+
+	for {
+		select {
+		case err := <-failed:
+			LOGGING_FUNC("Polling", SHARED_FILES_DIR, "every", SHARED_FILES_POLL_PERIOD, "as we stopped watching it:", err)
+			rewatch = nil
+			go pollSharedFiles(SHARED_FILES_DIR, changes)
+			continue
+		case <-retry:
+		case <-changes:
+			waitSharedFilesSettle(changes)
+		}
+		retry = nil
+
+		// Directories created since the last export must be watched too
+		if rewatch != nil {
+			err = rewatch()
+			if err != nil {
+				LOGGING_FUNC("Polling", SHARED_FILES_DIR, "every", SHARED_FILES_POLL_PERIOD, "instead of watching it:", err)
+				rewatch = nil
+				go pollSharedFiles(SHARED_FILES_DIR, changes)
+			}
+		}
+
+		previousTree, _ := ourTreeGet()
+		changed, err := exportMerkleTree()
+		if err != nil && previousTree == nil {
+			fmt.Fprintln(os.Stderr, "Couldn't export", SHARED_FILES_DIR+", we share nothing until it succeeds:", err)
+			retry = time.After(SHARED_FILES_SETTLE_DELAY)
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Couldn't export", SHARED_FILES_DIR+", we keep sharing the previous files:", err)
+			continue
+		}
+
+		tree, _ := ourTreeGet()
+		if previousTree == nil {
+			LOGGING_FUNC_F("Sharing %s, root %x\n", SHARED_FILES_DIR, tree.Hash)
+		} else if changed {
+			LOGGING_FUNC_F("Shared files changed, root %x replaced by %x\n", previousTree.Hash, tree.Hash)
+		}
+	}
+}
+
+// Returns once no change was signaled for SHARED_FILES_SETTLE_DELAY, or after SHARED_FILES_MAX_SETTLE_WAIT
+func waitSharedFilesSettle(changes chan struct{}) {
+	timer := time.NewTimer(SHARED_FILES_SETTLE_DELAY)
+	defer timer.Stop()
+	deadline := time.NewTimer(SHARED_FILES_MAX_SETTLE_WAIT)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case <-changes:
+			timer.Reset(SHARED_FILES_SETTLE_DELAY)
+		case <-timer.C:
+			return
+		case <-deadline.C:
+			return
+		}
+	}
+}
+
+// Signals a change when the path, size or modification time of an entry under root changes
+func pollSharedFiles(root string, changes chan struct{}) {
+	previous := sharedFilesSnapshot(root)
+	for {
+		time.Sleep(SHARED_FILES_POLL_PERIOD)
+
+		current := sharedFilesSnapshot(root)
+		if !slices.Equal(previous, current) {
+			select {
+			case changes <- struct{}{}:
+			default: // A change is already signaled
+			}
+		}
+		previous = current
+	}
+}
+
+// One line per entry under root, in lexical order
+func sharedFilesSnapshot(root string) []string {
+	res := []string{}
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Removed while walking, the next snapshot won't have it
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		res = append(res, fmt.Sprintf("%s %d %d", path, info.Size(), info.ModTime().UnixNano()))
+		return nil
+	})
+	return res
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"syscall"
+)
+
+// Events that can change the tree, inotify reports them for the entries of a watched directory
+const INOTIFY_MASK = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+const INOTIFY_BUFFER_SIZE = 64 * 1024
+
+// Watches every directory under root with inotify and signals changes in changes
+// inotify is not recursive, the returned function watches the directories created since the last call
+// If reading the events fails, the watcher stops and sends the error in failed
+func startSharedFilesWatcher(root string, changes chan struct{}, failed chan error) (func() error, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %w", err)
+	}
+
+	rewatch := func() error {
+		return inotifyWatchTree(fd, root)
+	}
+	err = rewatch()
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	go func() {
+		// The events are not parsed, the whole tree is compared with the previous export anyway
+		buffer := make([]byte, INOTIFY_BUFFER_SIZE)
+		for {
+			n, err := syscall.Read(fd, buffer)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil || n <= 0 {
+				if err == nil {
+					err = fmt.Errorf("inotify read returned %d", n)
+				}
+				syscall.Close(fd)
+				failed <- err
+				return
+			}
+
+			select {
+			case changes <- struct{}{}:
+			default: // A change is already signaled
+			}
+		}
+	}()
+
+	return rewatch, nil
+}
+
+// Adding a watch to a directory already watched only updates its mask
+func inotifyWatchTree(fd int, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil // Removed while walking
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		_, err = syscall.InotifyAddWatch(fd, path, INOTIFY_MASK)
+		if err != nil {
+			// ENOSPC when fs.inotify.max_user_watches is reached
+			return fmt.Errorf("inotify_add_watch %s: %w", path, err)
+		}
+		return nil
+	})
+}
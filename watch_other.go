@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// inotify is only used on Linux, SHARED_FILES_DIR is polled elsewhere
+func startSharedFilesWatcher(root string, changes chan struct{}, failed chan error) (func() error, error) {
+	return nil, fmt.Errorf("no file watcher on this system")
+}